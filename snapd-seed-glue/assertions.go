@@ -16,7 +16,6 @@ import (
     "encoding/base64"
     "encoding/hex"
     "fmt"
-    "log"
     "os"
     "path/filepath"
     "strings"
@@ -60,6 +59,7 @@ func downloadAssertions(storeClient *store.Store, snapInfo *snap.Info, downloadD
     if err != nil {
         return fmt.Errorf("failed to fetch snap-declaration assertion for snap %s: %w", snapInfo.SuggestedName, err)
     }
+    assertionFetched("snap-declaration", snapInfo.SuggestedName)
 
     // Step 2: Extract sign-key-sha3-384 from snap-declaration
     signKey, ok := snapDecl.Header("sign-key-sha3-384").(string)
@@ -72,12 +72,14 @@ func downloadAssertions(storeClient *store.Store, snapInfo *snap.Info, downloadD
     if err != nil {
         return fmt.Errorf("failed to fetch account-key assertion for snap %s: %w", snapInfo.SuggestedName, err)
     }
+    assertionFetched("account-key", snapInfo.SuggestedName)
 
     // Step 4: Fetch account assertion using publisher-id
     accountAssertion, err := storeClient.Assertion(assertionTypes["account"], []string{publisherID}, nil)
     if err != nil {
         return fmt.Errorf("failed to fetch account assertion for snap %s: %w", snapInfo.SuggestedName, err)
     }
+    assertionFetched("account", snapInfo.SuggestedName)
 
     // Step 5: Fetch snap-revision assertion
     snapSHA384Bytes, err := hex.DecodeString(snapSHA)
@@ -93,6 +95,7 @@ func downloadAssertions(storeClient *store.Store, snapInfo *snap.Info, downloadD
         verboseLog("Failed to fetch snap-revision assertion for snap %s: %v", snapInfo.SuggestedName, err)
         // Proceeding without snap-revision might be acceptable based on your use-case
     }
+    assertionFetched("snap-revision", snapInfo.SuggestedName)
 
     // Step 6: Write assertions in the desired order
     // 1. account-key
@@ -113,6 +116,11 @@ func downloadAssertions(storeClient *store.Store, snapInfo *snap.Info, downloadD
     return nil
 }
 
+// assertionFetched advances the progress by one store request for an assertion of a snap
+func assertionFetched(assertionType, snapName string) {
+    progressTracker.Advance(requestCost, fmt.Sprintf(G("Fetched %s assertion for snap %s"), assertionType, snapName))
+}
+
 func writeAssertion(assertionType string, assertion asserts.Assertion, file *os.File) {
     fieldOrder := map[string][]string{
         "account-key": {
@@ -201,7 +209,7 @@ func serializeComplexField(value interface{}, file *os.File) {
 
     // Encode the value directly
     if err := encoder.Encode(value); err != nil {
-        log.Fatalf("Error encoding YAML: %v", err)
+        fatalf("Error encoding YAML: %v", err)
     }
 
     // Write the serialized YAML to the file with proper indentation
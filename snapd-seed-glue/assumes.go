@@ -0,0 +1,144 @@
+// Copyright (C) 2024 Simon Quigley <tsimonq2@ubuntu.com>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 3
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+package main
+
+import (
+    "fmt"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+
+    "github.com/snapcore/snapd/snap"
+)
+
+// snapdFeatures are the assumes entries other than snapdX.Y that snapd provides, mirroring
+// featureSet in snapd's overlord/snapstate/check_snap.go
+var snapdFeatures = map[string]bool{
+    "common-data-dir":  true,
+    "snap-env":         true,
+    "command-chain":    true,
+    "kernel-assets":    true,
+    "app-refresh-mode": true,
+    "snap-uid-envvars": true,
+}
+
+// snapdVersionExp matches a version made of groups of digits separated by dots, as snapd does for assumes
+var snapdVersionExp = regexp.MustCompile(`^(?:[1-9][0-9]*)(?:\.(?:[0-9]+))*`)
+
+// assumesProblem is a requirement of a snap that the seed does not meet
+type assumesProblem struct {
+    Snap   string
+    Reason string
+}
+
+// checkSeedAssumes checks the assumes of every snap of the resolved seed against the seeded snapd,
+// and checks that the base every snap names is seeded and is of type base
+func checkSeedAssumes() []assumesProblem {
+    var problems []assumesProblem
+
+    snapdVersion := ""
+    if info := snapInfoMap["snapd"]; info != nil {
+        snapdVersion = info.Version
+    }
+
+    var names []string
+    for name := range snapInfoMap {
+        if requiredSnaps[name] {
+            names = append(names, name)
+        }
+    }
+    sort.Strings(names)
+
+    for _, name := range names {
+        info := snapInfoMap[name]
+        var missing []string
+        for _, feature := range info.Assumes {
+            if !snapdProvides(feature, snapdVersion) {
+                missing = append(missing, feature)
+            }
+        }
+        if len(missing) > 0 {
+            reason := fmt.Sprintf("assumes %s, which snapd %s in the seed does not provide", strings.Join(missing, ", "), snapdVersion)
+            if snapdVersion == "" {
+                reason = fmt.Sprintf("assumes %s, but snapd is not in the seed", strings.Join(missing, ", "))
+            }
+            problems = append(problems, assumesProblem{
+                Snap:   name,
+                Reason: reason,
+            })
+        }
+
+        if info.Base != "" {
+            baseInfo := snapInfoMap[info.Base]
+            switch {
+            case baseInfo == nil || !requiredSnaps[info.Base]:
+                problems = append(problems, assumesProblem{
+                    Snap:   name,
+                    Reason: fmt.Sprintf("needs base %s, which is not in the seed", info.Base),
+                })
+            case baseInfo.Type() != snap.TypeBase && baseInfo.Type() != snap.TypeOS:
+                problems = append(problems, assumesProblem{
+                    Snap:   name,
+                    Reason: fmt.Sprintf("needs base %s, which is a snap of type %s rather than a base", info.Base, baseInfo.Type()),
+                })
+            }
+        }
+    }
+    return problems
+}
+
+// snapdProvides checks a single assumes entry against the given snapd version
+func snapdProvides(feature, snapdVersion string) bool {
+    if strings.HasPrefix(feature, "snapd") && feature != "snapd" {
+        return snapdVersionAtLeast(feature[len("snapd"):], snapdVersion)
+    }
+    return snapdFeatures[feature]
+}
+
+// snapdVersionAtLeast compares the numeric part of the snapd version with a required version such as 2.61
+func snapdVersionAtLeast(required, snapdVersion string) bool {
+    // Like snapd, only accept plain version numbers as requirement
+    if snapdVersionExp.FindString(required) != required {
+        return false
+    }
+    current := snapdVersionExp.FindString(snapdVersion)
+    if current == "" {
+        return false
+    }
+
+    req := strings.Split(required, ".")
+    cur := strings.Split(current, ".")
+    for i := range req {
+        if i == len(cur) {
+            return false
+        }
+        reqN, _ := strconv.Atoi(req[i])
+        curN, _ := strconv.Atoi(cur[i])
+        if curN != reqN {
+            return curN > reqN
+        }
+    }
+    return true
+}
+
+// reportAssumesProblems reports every problem found by checkSeedAssumes, failing the run if strict is set
+func reportAssumesProblems(strict bool) {
+    problems := checkSeedAssumes()
+    for _, problem := range problems {
+        warnf("Snap %s %s", problem.Snap, problem.Reason)
+    }
+    if strict && len(problems) > 0 {
+        failf(errKindRequirements, "The seed does not meet the requirements of its snaps, not downloading anything")
+    }
+}
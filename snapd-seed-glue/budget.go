@@ -0,0 +1,213 @@
+// Copyright (C) 2024 Simon Quigley <tsimonq2@ubuntu.com>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 3
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+package main
+
+import (
+    "fmt"
+    "log"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+
+    "github.com/snapcore/snapd/strutil"
+)
+
+// sizeUnits are the multipliers of the size suffixes accepted by parseSize
+var sizeUnits = map[string]int64{
+    "":   1,
+    "b":  1,
+    "k":  1000,
+    "kb": 1000,
+    "m":  1000 * 1000,
+    "mb": 1000 * 1000,
+    "g":  1000 * 1000 * 1000,
+    "gb": 1000 * 1000 * 1000,
+    "t":  1000 * 1000 * 1000 * 1000,
+    "tb": 1000 * 1000 * 1000 * 1000,
+    "ki": 1 << 10,
+    "mi": 1 << 20,
+    "gi": 1 << 30,
+    "ti": 1 << 40,
+}
+
+var (
+    // maxSeedSize is the size budget of the whole seed, 0 for none
+    maxSeedSize sizeFlag
+    // snapBudgets are the size budgets of single snaps
+    snapBudgets = make(map[string]int64)
+)
+
+// parseSize parses sizes such as 2.5G, 700M or 1GiB into bytes
+func parseSize(value string) (int64, error) {
+    value = strings.TrimSpace(value)
+    i := strings.IndexFunc(value, func(r rune) bool {
+        return (r < '0' || r > '9') && r != '.'
+    })
+    number, unit := value, ""
+    if i >= 0 {
+        number, unit = value[:i], value[i:]
+    }
+    unit = strings.ToLower(strings.TrimSpace(unit))
+    // Binary units may be written as Gi or GiB
+    if strings.HasSuffix(unit, "ib") {
+        unit = strings.TrimSuffix(unit, "b")
+    }
+    multiplier, ok := sizeUnits[unit]
+    if !ok {
+        return 0, fmt.Errorf("invalid size %q", value)
+    }
+    n, err := strconv.ParseFloat(number, 64)
+    if err != nil || n < 0 {
+        return 0, fmt.Errorf("invalid size %q", value)
+    }
+    return int64(n * float64(multiplier)), nil
+}
+
+// sizeFlag is a flag.Value for a size in bytes given with an optional unit
+type sizeFlag int64
+
+func (s *sizeFlag) String() string {
+    if *s == 0 {
+        return ""
+    }
+    return strutil.SizeToStr(int64(*s))
+}
+
+func (s *sizeFlag) Set(value string) error {
+    size, err := parseSize(value)
+    if err != nil {
+        return err
+    }
+    *s = sizeFlag(size)
+    return nil
+}
+
+// snapBudgetFlag is a flag.Value for NAME=SIZE budgets of single snaps
+type snapBudgetFlag struct{}
+
+func (snapBudgetFlag) String() string {
+    var budgets []string
+    for name, size := range snapBudgets {
+        budgets = append(budgets, name+"="+strutil.SizeToStr(size))
+    }
+    sort.Strings(budgets)
+    return strings.Join(budgets, ",")
+}
+
+func (snapBudgetFlag) Set(value string) error {
+    name, sizeValue, found := strings.Cut(value, "=")
+    if !found || name == "" {
+        return fmt.Errorf("expected NAME=SIZE, got %q", value)
+    }
+    size, err := parseSize(sizeValue)
+    if err != nil {
+        return err
+    }
+    snapBudgets[name] = size
+    return nil
+}
+
+// seedSnapSize is the size a snap takes up in the final seed
+type seedSnapSize struct {
+    Name string
+    Size int64
+    // New is set for snaps that still have to be downloaded or copied in
+    New bool
+}
+
+// finalSeedSizes returns the sizes of all snaps of the resolved seed, largest first.
+// Snaps already in the seed are measured on disk, others use the size the store reports.
+func finalSeedSizes(snapsToProcess []SnapDetails, snapsDir string) []seedSnapSize {
+    pending := make(map[string]SnapDetails)
+    for _, details := range snapsToProcess {
+        pending[details.InstanceName] = details
+    }
+
+    var sizes []seedSnapSize
+    for _, current := range currentSnaps {
+        if !requiredSnaps[current.InstanceName] {
+            continue
+        }
+        size := seedSnapSize{Name: current.InstanceName}
+        if details, ok := pending[current.InstanceName]; ok {
+            size.New = true
+            if details.LocalPath != "" {
+                if fi, err := os.Stat(details.LocalPath); err == nil {
+                    size.Size = fi.Size()
+                }
+            } else if details.Result != nil && details.Result.Info != nil {
+                size.Size = details.Result.Info.Size
+            }
+        } else if fi, err := os.Stat(filepath.Join(snapsDir, fmt.Sprintf("%s_%s.snap", current.InstanceName, current.Revision))); err == nil {
+            size.Size = fi.Size()
+        } else if info := snapInfoMap[current.InstanceName]; info != nil {
+            size.Size = info.Size
+        }
+        sizes = append(sizes, size)
+    }
+
+    sort.Slice(sizes, func(i, j int) bool {
+        if sizes[i].Size != sizes[j].Size {
+            return sizes[i].Size > sizes[j].Size
+        }
+        return sizes[i].Name < sizes[j].Name
+    })
+    return sizes
+}
+
+// enforceSizeBudgets fails the run before anything is downloaded if the resolved seed
+// or any of its snaps is larger than its budget
+func enforceSizeBudgets(snapsToProcess []SnapDetails, snapsDir string) {
+    if maxSeedSize == 0 && len(snapBudgets) == 0 {
+        return
+    }
+
+    sizes := finalSeedSizes(snapsToProcess, snapsDir)
+    var total int64
+    for _, size := range sizes {
+        total += size.Size
+    }
+
+    var failures []string
+    for _, size := range sizes {
+        if budget, ok := snapBudgets[size.Name]; ok && size.Size > budget {
+            failures = append(failures, fmt.Sprintf("snap %s is %s, %s over its budget of %s",
+                size.Name, strutil.SizeToStr(size.Size), strutil.SizeToStr(size.Size-budget), strutil.SizeToStr(budget)))
+        }
+    }
+    if maxSeedSize > 0 && total > int64(maxSeedSize) {
+        failures = append(failures, fmt.Sprintf("seed is %s, %s over its budget of %s",
+            strutil.SizeToStr(total), strutil.SizeToStr(total-int64(maxSeedSize)), strutil.SizeToStr(int64(maxSeedSize))))
+    }
+    if len(failures) == 0 {
+        verboseLog("Seed size %s is within budget", strutil.SizeToStr(total))
+        return
+    }
+
+    log.Printf("Size of the resolved seed:")
+    for _, size := range sizes {
+        state := "kept"
+        if size.New {
+            state = "new"
+        }
+        share := 0.0
+        if total > 0 {
+            share = float64(size.Size) / float64(total) * 100
+        }
+        log.Printf("  %-30s %10s  %5.1f%%  %s", size.Name, strutil.SizeToStr(size.Size), share, state)
+    }
+    log.Printf("  %-30s %10s", "total", strutil.SizeToStr(total))
+    failf(errKindRequirements, "Seed is over budget, not downloading anything: %s", strings.Join(failures, "; "))
+}
@@ -14,10 +14,12 @@ package main
 
 import (
     "fmt"
+    "log"
     "os"
     "path/filepath"
     "strings"
 
+    "github.com/snapcore/snapd/snap"
     "github.com/snapcore/snapd/store"
 )
 
@@ -28,6 +30,22 @@ func cleanUpFiles(snapsDir string, assertionsDir string) {
     // Load the seed.yaml data
     seedData := loadSeedData()
 
+    for _, filePath := range staleSeedFiles(snapsDir, assertionsDir, seedData) {
+        if err := os.Remove(filePath); err != nil {
+            verboseLog("Failed to remove file %s: %v", filePath, err)
+        } else if verbose {
+            verboseLog("Removed file: %s", filePath)
+        }
+        progressTracker.Advance(cleanupCost, "")
+    }
+
+    verboseLog("Cleanup process completed.")
+}
+
+// staleSeedFiles returns the partial, delta, and snap and assertion files that seedData no longer references.
+func staleSeedFiles(snapsDir string, assertionsDir string, seedData seed) []string {
+    var staleFiles []string
+
     // Create a map of valid snap and assertion files based on seed.yaml
     validSnaps := make(map[string]bool)
     validAssertions := make(map[string]bool)
@@ -51,7 +69,7 @@ func cleanUpFiles(snapsDir string, assertionsDir string) {
     verboseLog("Valid Snaps: %v", validSnaps)
     verboseLog("Valid Assertions: %v", validAssertions)
 
-    // Remove outdated or partial snap files
+    // Find outdated or partial snap files
     files, err := os.ReadDir(snapsDir)
     if err != nil {
         verboseLog("Error reading snaps directory for cleanup: %v", err)
@@ -59,20 +77,12 @@ func cleanUpFiles(snapsDir string, assertionsDir string) {
         for _, file := range files {
             filePath := filepath.Join(snapsDir, file.Name())
             if strings.HasSuffix(file.Name(), ".partial") || strings.HasSuffix(file.Name(), ".delta") {
-                verboseLog("Removing partial/delta file: %s\n", filePath)
-                if err := os.Remove(filePath); err != nil {
-                    verboseLog("Failed to remove file %s: %v", filePath, err)
-                } else if verbose {
-                    verboseLog("Removed partial/delta file: %s", filePath)
-                }
+                verboseLog("Partial/delta file to remove: %s\n", filePath)
+                staleFiles = append(staleFiles, filePath)
             } else if strings.HasSuffix(file.Name(), ".snap") {
                 if !validSnaps[file.Name()] {
-                    verboseLog("Removing outdated or orphaned snap file: %s\n", filePath)
-                    if err := os.Remove(filePath); err != nil {
-                        verboseLog("Failed to remove snap file %s: %v", filePath, err)
-                    } else if verbose {
-                        verboseLog("Removed snap file: %s", filePath)
-                    }
+                    verboseLog("Outdated or orphaned snap file to remove: %s\n", filePath)
+                    staleFiles = append(staleFiles, filePath)
                 } else {
                     verboseLog("Snap file %s is valid and retained.\n", file.Name())
                 }
@@ -80,7 +90,7 @@ func cleanUpFiles(snapsDir string, assertionsDir string) {
         }
     }
 
-    // Remove orphaned assertion files
+    // Find orphaned assertion files
     files, err = os.ReadDir(assertionsDir)
     if err != nil {
         verboseLog("Error reading assertions directory for cleanup: %v", err)
@@ -89,12 +99,8 @@ func cleanUpFiles(snapsDir string, assertionsDir string) {
             filePath := filepath.Join(assertionsDir, file.Name())
             if strings.HasSuffix(file.Name(), ".assert") {
                 if !validAssertions[file.Name()] {
-                    verboseLog("Removing orphaned assertion file: %s\n", filePath)
-                    if err := os.Remove(filePath); err != nil {
-                        verboseLog("Failed to remove assertion file %s: %v", filePath, err)
-                    } else if verbose {
-                        verboseLog("Removed assertion file: %s", filePath)
-                    }
+                    verboseLog("Orphaned assertion file to remove: %s\n", filePath)
+                    staleFiles = append(staleFiles, filePath)
                 } else {
                     verboseLog("Assertion file %s is valid and retained.\n", file.Name())
                 }
@@ -102,13 +108,13 @@ func cleanUpFiles(snapsDir string, assertionsDir string) {
         }
     }
 
-    verboseLog("Cleanup process completed.")
+    return staleFiles
 }
 
 // removeOrphanedFiles deletes the assertion and snap file corresponding to the removed snap.
-func removeOrphanedFiles(snapName string, revision int, assertionsDir string, snapsDir string) {
-    assertionFilePath := filepath.Join(assertionsDir, fmt.Sprintf("%s_%d.assert", snapName, revision))
-    snapFilePath := filepath.Join(snapsDir, fmt.Sprintf("%s_%d.snap", snapName, revision))
+func removeOrphanedFiles(snapName string, revision snap.Revision, assertionsDir string, snapsDir string) {
+    assertionFilePath := filepath.Join(assertionsDir, fmt.Sprintf("%s_%s.assert", snapName, revision))
+    snapFilePath := filepath.Join(snapsDir, fmt.Sprintf("%s_%s.snap", snapName, revision))
     if fileExists(assertionFilePath) {
         err := os.Remove(assertionFilePath)
         if err != nil {
@@ -133,23 +139,35 @@ func removeOrphanedFiles(snapName string, revision int, assertionsDir string, sn
 
 // cleanUpCurrentSnaps removes snaps from currentSnaps that are not marked as required.
 func cleanUpCurrentSnaps(assertionsDir string, snapsDir string) {
-    var filteredSnaps []*store.CurrentSnap
-
-    for _, snap := range currentSnaps {
-        if requiredSnaps[snap.InstanceName] {
-            filteredSnaps = append(filteredSnaps, snap)
+    filteredSnaps, removedSnaps := splitRequiredSnaps()
+    runSummary.removed = len(removedSnaps)
+    for _, snap := range removedSnaps {
+        if reason := removalReasons[snap.InstanceName]; reason != "" {
+            log.Printf("Removing %s from the seed: %s", snap.InstanceName, reason)
         } else {
             verboseLog("Removing unnecessary snap: %s\n", snap.InstanceName)
-            removeOrphanedFiles(snap.InstanceName, snap.Revision.N, assertionsDir, snapsDir)
         }
+        removeOrphanedFiles(snap.InstanceName, snap.Revision, assertionsDir, snapsDir)
     }
     currentSnaps = filteredSnaps
 
     // Log the updated currentSnaps
     verboseLog("Filtered currentSnaps after cleanup:")
     for _, snap := range currentSnaps {
-        verboseLog("- %s_%d.snap", snap.InstanceName, snap.Revision.N)
+        verboseLog("- %s_%s.snap", snap.InstanceName, snap.Revision)
+    }
+}
+
+// splitRequiredSnaps splits currentSnaps into the snaps marked as required and the ones that are not.
+func splitRequiredSnaps() (required []*store.CurrentSnap, unrequired []*store.CurrentSnap) {
+    for _, snap := range currentSnaps {
+        if requiredSnaps[snap.InstanceName] {
+            required = append(required, snap)
+        } else {
+            unrequired = append(unrequired, snap)
+        }
     }
+    return required, unrequired
 }
 
 // removeStateJson removes the state.json file if it exists
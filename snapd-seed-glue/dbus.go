@@ -0,0 +1,191 @@
+// Copyright (C) 2024 Simon Quigley <tsimonq2@ubuntu.com>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 3
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+package main
+
+import (
+    "fmt"
+    "sync"
+    "time"
+
+    "github.com/godbus/dbus"
+    "github.com/godbus/dbus/introspect"
+    "github.com/godbus/dbus/prop"
+)
+
+// Names the progress service is published under
+const (
+    dbusBusName    = "org.lubuntu.SnapdSeedGlue"
+    dbusObjectPath = dbus.ObjectPath("/org/lubuntu/SnapdSeedGlue")
+    dbusInterface  = "org.lubuntu.SnapdSeedGlue.Progress"
+)
+
+// Buses the progress service can be published on
+const (
+    dbusSessionBus = "session"
+    dbusSystemBus  = "system"
+)
+
+// dbusStateRunning is the State property until the run ends with success or failure
+const dbusStateRunning = "running"
+
+// DBusProgressReporter publishes progress as properties and signals of a D-Bus object,
+// so desktop components can show how far seeding has come
+type DBusProgressReporter struct {
+    mu     sync.Mutex
+    conn   *dbus.Conn
+    props  *prop.Properties
+    phase  string
+    closed bool
+}
+
+// NewDBusProgressReporter connects to the given bus, session or system, and publishes the progress service.
+// The session bus is found through DBUS_SESSION_BUS_ADDRESS, so a private dbus-daemon works as well.
+func NewDBusProgressReporter(bus string) (*DBusProgressReporter, error) {
+    var conn *dbus.Conn
+    var err error
+    switch bus {
+    case dbusSessionBus:
+        conn, err = dbus.SessionBusPrivate()
+    case dbusSystemBus:
+        conn, err = dbus.SystemBusPrivate()
+    default:
+        return nil, fmt.Errorf("unknown bus %q, expected %s or %s", bus, dbusSessionBus, dbusSystemBus)
+    }
+    if err != nil {
+        return nil, fmt.Errorf("failed to connect to the %s bus: %w", bus, err)
+    }
+    if err := conn.Auth(nil); err != nil {
+        conn.Close()
+        return nil, fmt.Errorf("failed to authenticate to the %s bus: %w", bus, err)
+    }
+    if err := conn.Hello(); err != nil {
+        conn.Close()
+        return nil, fmt.Errorf("failed to register on the %s bus: %w", bus, err)
+    }
+
+    reporter := &DBusProgressReporter{conn: conn}
+    if err := reporter.export(); err != nil {
+        conn.Close()
+        return nil, err
+    }
+
+    reply, err := conn.RequestName(dbusBusName, dbus.NameFlagDoNotQueue)
+    if err != nil {
+        conn.Close()
+        return nil, fmt.Errorf("failed to request %s on the %s bus: %w", dbusBusName, bus, err)
+    }
+    if reply != dbus.RequestNameReplyPrimaryOwner {
+        conn.Close()
+        return nil, fmt.Errorf("%s is already taken on the %s bus, is another seeding run in progress?", dbusBusName, bus)
+    }
+    return reporter, nil
+}
+
+// export publishes the properties and the introspection data of the progress object
+func (d *DBusProgressReporter) export() error {
+    props, err := prop.Export(d.conn, dbusObjectPath, map[string]map[string]*prop.Prop{
+        dbusInterface: {
+            "State":       {Value: dbusStateRunning, Emit: prop.EmitTrue},
+            "Phase":       {Value: "", Emit: prop.EmitTrue},
+            "Percent":     {Value: int32(0), Emit: prop.EmitTrue},
+            "Message":     {Value: "", Emit: prop.EmitTrue},
+            "CurrentSnap": {Value: "", Emit: prop.EmitTrue},
+            "Bytes":       {Value: int64(0), Emit: prop.EmitTrue},
+            "TotalBytes":  {Value: int64(0), Emit: prop.EmitTrue},
+        },
+    })
+    if err != nil {
+        return fmt.Errorf("failed to export progress properties: %w", err)
+    }
+    d.props = props
+
+    node := &introspect.Node{
+        Name: string(dbusObjectPath),
+        Interfaces: []introspect.Interface{
+            introspect.IntrospectData,
+            prop.IntrospectData,
+            {
+                Name:       dbusInterface,
+                Properties: props.Introspection(dbusInterface),
+                Signals: []introspect.Signal{
+                    {Name: "PhaseChanged", Args: []introspect.Arg{{Name: "phase", Type: "s"}}},
+                    {Name: "Completed", Args: []introspect.Arg{{Name: "message", Type: "s"}}},
+                    {Name: "Failed", Args: []introspect.Arg{{Name: "message", Type: "s"}}},
+                },
+            },
+        },
+    }
+    if err := d.conn.Export(introspect.NewIntrospectable(node), dbusObjectPath, "org.freedesktop.DBus.Introspectable"); err != nil {
+        return fmt.Errorf("failed to export progress introspection: %w", err)
+    }
+    return nil
+}
+
+func (d *DBusProgressReporter) Report(percentage int, status string) {
+    d.Event(progressEvent{Type: eventProgress, Time: time.Now(), Percent: percentage, Message: status})
+}
+
+func (d *DBusProgressReporter) Event(event progressEvent) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    if d.closed {
+        return
+    }
+
+    d.set("Percent", int32(event.Percent))
+    switch event.Type {
+    case eventProgress, eventNotification:
+        d.set("Message", event.Message)
+    case eventPhaseStart:
+        d.set("Message", event.Message)
+        if event.Phase != d.phase {
+            d.phase = event.Phase
+            d.set("Phase", event.Phase)
+            d.emit("PhaseChanged", event.Phase)
+        }
+    case eventResolve:
+        d.set("CurrentSnap", event.Snap)
+    case eventDownload:
+        d.set("CurrentSnap", event.Snap)
+        d.set("Bytes", event.Bytes)
+        d.set("TotalBytes", event.Total)
+    case eventSummary:
+        d.set("Message", event.Message)
+        d.set("CurrentSnap", "")
+        d.set("State", event.Result)
+        if event.Result == resultSuccess {
+            d.emit("Completed", event.Message)
+        } else {
+            d.emit("Failed", event.Message)
+        }
+        // The summary is the last event, the service goes away with it
+        d.conn.ReleaseName(dbusBusName)
+        d.conn.Close()
+        d.closed = true
+    }
+}
+
+// set changes a property, sending PropertiesChanged only if its value is different
+func (d *DBusProgressReporter) set(name string, value interface{}) {
+    if d.props.GetMust(dbusInterface, name) == value {
+        return
+    }
+    d.props.SetMust(dbusInterface, name, value)
+}
+
+// emit sends a signal of the progress interface
+func (d *DBusProgressReporter) emit(signal string, values ...interface{}) {
+    if err := d.conn.Emit(dbusObjectPath, dbusInterface+"."+signal, values...); err != nil {
+        verboseLog("Failed to send D-Bus signal %s: %v", signal, err)
+    }
+}
@@ -0,0 +1,114 @@
+// Copyright (C) 2024 Simon Quigley <tsimonq2@ubuntu.com>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 3
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+package main
+
+import (
+    "fmt"
+    "io"
+    "sort"
+    "strings"
+)
+
+// Ways a snap can pull another snap into the seed
+const (
+    dependencyBase    = "base"
+    dependencyContent = "content"
+)
+
+// snapDependency is an edge from a snap to a snap it needs
+type snapDependency struct {
+    From string
+    To   string
+    Kind string
+    // Tags are the content tags the provider is the default-provider for
+    Tags []string
+}
+
+var (
+    // snapDependencies are all edges found while resolving the seed
+    snapDependencies []snapDependency
+    // requestedSnaps are the snaps asked for, as opposed to pulled in by another snap
+    requestedSnaps = make(map[string]bool)
+)
+
+// recordDependency remembers that snap from needs snap to
+func recordDependency(from, to, kind string, tags []string) {
+    sortedTags := append([]string(nil), tags...)
+    sort.Strings(sortedTags)
+    snapDependencies = append(snapDependencies, snapDependency{From: from, To: to, Kind: kind, Tags: sortedTags})
+}
+
+// describe formats the edge for the snap it leads to
+func (d snapDependency) describe() string {
+    if d.Kind == dependencyContent {
+        return fmt.Sprintf("content default-provider for %s", strings.Join(d.Tags, ", "))
+    }
+    return "base"
+}
+
+// dependencyChains returns every chain of edges leading from a requested snap to the given snap
+func dependencyChains(snapName string) [][]snapDependency {
+    var chains [][]snapDependency
+    var walk func(name string, chain []snapDependency, seen map[string]bool)
+    walk = func(name string, chain []snapDependency, seen map[string]bool) {
+        if requestedSnaps[name] && len(chain) > 0 {
+            chains = append(chains, chain)
+        }
+        for _, dep := range snapDependencies {
+            if dep.To != name || seen[dep.From] {
+                continue
+            }
+            seen[dep.From] = true
+            walk(dep.From, append([]snapDependency{dep}, chain...), seen)
+            delete(seen, dep.From)
+        }
+    }
+    walk(snapName, nil, map[string]bool{snapName: true})
+
+    sort.Slice(chains, func(i, j int) bool {
+        return formatChain(chains[i]) < formatChain(chains[j])
+    })
+    return chains
+}
+
+// formatChain formats a chain as "requested -> snap (kind) -> snap (kind)"
+func formatChain(chain []snapDependency) string {
+    parts := []string{chain[0].From + " (requested)"}
+    for _, dep := range chain {
+        parts = append(parts, fmt.Sprintf("%s (%s)", dep.To, dep.describe()))
+    }
+    return strings.Join(parts, " -> ")
+}
+
+// explainSnap prints why a snap is part of the resolved seed, returning false if it is not
+func explainSnap(w io.Writer, snapName string) bool {
+    if !requiredSnaps[snapName] {
+        fmt.Fprintf(w, "%s is not in the seed\n", snapName)
+        return false
+    }
+
+    if snapName == "snapd" || snapName == "bare" {
+        fmt.Fprintf(w, "%s is always seeded\n", snapName)
+    } else if requestedSnaps[snapName] {
+        fmt.Fprintf(w, "%s was requested\n", snapName)
+    }
+
+    chains := dependencyChains(snapName)
+    if len(chains) > 0 {
+        fmt.Fprintf(w, "%s is needed by:\n", snapName)
+        for _, chain := range chains {
+            fmt.Fprintf(w, "  %s\n", formatChain(chain))
+        }
+    }
+    return true
+}
@@ -14,6 +14,7 @@ package main
 
 import (
     "fmt"
+    "os"
     "os/exec"
     "path/filepath"
     "time"
@@ -29,7 +30,6 @@ func downloadSnap(storeClient *store.Store, snapInfo *snap.Info, downloadPath st
     }
 
     pbar := NewProgressMeter(snapInfo.SuggestedName, snapInfo.Version, false)
-    progressTracker.UpdateStepProgress(0)
 
     for attempts := 1; attempts <= 5; attempts++ {
         verboseLog("Attempt %d to download snap: %s", attempts, downloadPath)
@@ -40,11 +40,9 @@ func downloadSnap(storeClient *store.Store, snapInfo *snap.Info, downloadPath st
         }
         if verbose {
             verboseLog("Attempt %d to download %s failed: %v", attempts, snapInfo.SuggestedName, err)
-        } else if progressTracker != nil {
-            progressTracker.UpdateStepProgress(0)
         }
         if attempts == 5 {
-            return fmt.Errorf("snap download failed after 5 attempts: %v", err)
+            return fmt.Errorf("snap download failed after 5 attempts: %w", err)
         }
     }
     return fmt.Errorf("snap download failed after 5 attempts")
@@ -69,7 +67,7 @@ func downloadSnapDeltaWithRetries(storeClient *store.Store, delta *snap.DeltaInf
         time.Sleep(backoff)
         backoff *= 2
     }
-    return fmt.Errorf("delta download failed after %d attempts: %v", maxRetries, lastErr)
+    return fmt.Errorf("delta download failed after %d attempts: %w", maxRetries, lastErr)
 }
 
 // downloadSnapDelta downloads the delta file.
@@ -86,12 +84,10 @@ func downloadSnapDelta(storeClient *store.Store, delta *snap.DeltaInfo, result *
     snapID := result.Info.SnapID
 
     pbar := NewProgressMeter(result.Info.SuggestedName, result.Info.Version, true)
-    progressTracker.UpdateStepProgress(0)
 
     // Download the delta file
     if err := storeClient.Download(ctx, snapID, deltaPath, downloadInfo, pbar, nil, nil); err != nil {
-        progressTracker.UpdateStepProgress(0)
-        return fmt.Errorf("delta download failed: %v", err)
+        return fmt.Errorf("delta download failed: %w", err)
     }
     verboseLog("Downloaded %s to %s", delta.DownloadURL, deltaPath)
     pbar.Finished()
@@ -119,9 +115,10 @@ func downloadAndApplySnap(storeClient *store.Store, result *store.SnapActionResu
                 if fileExists(oldSnapPath) {
                     if err := applyDelta(oldSnapPath, deltaPath, downloadPath); err == nil {
                         verboseLog("Delta applied successfully for snap %s", snapInfo.SuggestedName)
+                        recordSnapMethod(snapInfo.SuggestedName, methodDelta, snapInfo.Size-delta.Size)
                         // Download assertions after successful snap download
                         if err := downloadAssertions(storeClient, snapInfo, assertionsDir); err != nil {
-                            return nil, fmt.Errorf("failed to download assertions for snap %s: %w", snapInfo.SuggestedName, err)
+                            return nil, &AssertionError{Snap: snapInfo.SuggestedName, Err: fmt.Errorf("failed to download assertions for snap %s: %w", snapInfo.SuggestedName, err)}
                         }
                         return snapInfo, nil // Successful delta application
                     } else {
@@ -138,12 +135,13 @@ func downloadAndApplySnap(storeClient *store.Store, result *store.SnapActionResu
 
     // If no delta was applied or no deltas are available, fallback to downloading the full snap
     if err := downloadSnap(storeClient, snapInfo, downloadPath); err != nil {
-        return nil, fmt.Errorf("failed to download snap %s: %w", snapInfo.SuggestedName, err)
+        return nil, &DownloadError{Snap: snapInfo.SuggestedName, Err: fmt.Errorf("failed to download snap %s: %w", snapInfo.SuggestedName, err)}
     }
+    recordSnapMethod(snapInfo.SuggestedName, methodFull, 0)
 
     // Download assertions after successful snap download
     if err := downloadAssertions(storeClient, snapInfo, assertionsDir); err != nil {
-        return nil, fmt.Errorf("failed to download assertions for snap %s: %w", snapInfo.SuggestedName, err)
+        return nil, &AssertionError{Snap: snapInfo.SuggestedName, Err: fmt.Errorf("failed to download assertions for snap %s: %w", snapInfo.SuggestedName, err)}
     }
 
     verboseLog("Downloaded and applied snap: %s, revision: %d", snapInfo.SuggestedName, snapInfo.Revision.N)
@@ -154,11 +152,14 @@ func downloadAndApplySnap(storeClient *store.Store, result *store.SnapActionResu
 func applyDelta(oldSnapPath, deltaPath, newSnapPath string) error {
     verboseLog("Applying delta from %s to %s using %s", oldSnapPath, newSnapPath, deltaPath)
 
-    cmd := exec.Command("xdelta3", "-d", "-s", oldSnapPath, deltaPath, newSnapPath)
+    // Write to a partial file first, so a failed run never leaves a broken snap or writes through a staged link
+    partialPath := newSnapPath + ".partial"
+    cmd := exec.Command("xdelta3", "-d", "-f", "-s", oldSnapPath, deltaPath, partialPath)
     output, err := cmd.CombinedOutput()
     if err != nil {
+        os.Remove(partialPath)
         verboseLog("xdelta3 output: %s", string(output))
         return fmt.Errorf("failed to apply delta: %v - %s", err, string(output))
     }
-    return nil
+    return os.Rename(partialPath, newSnapPath)
 }
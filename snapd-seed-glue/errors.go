@@ -0,0 +1,285 @@
+// Copyright (C) 2024 Simon Quigley <tsimonq2@ubuntu.com>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 3
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net"
+    "os"
+    "strings"
+    "syscall"
+    "time"
+
+    "github.com/snapcore/snapd/httputil"
+    "github.com/snapcore/snapd/store"
+)
+
+// errorKind is a class of failure. Installers rely on the IDs and exit codes, so they never change.
+type errorKind struct {
+    ID       string
+    ExitCode int
+}
+
+// Kinds of failure, exit code 1 is also used by why and lint to say the answer is no
+var (
+    errKindInternal             = errorKind{"internal", 1}
+    errKindUsage                = errorKind{"usage", 2}
+    errKindNetwork              = errorKind{"network-unreachable", 3}
+    errKindSnapNotFound         = errorKind{"snap-not-found", 4}
+    errKindRevisionNotAvailable = errorKind{"revision-not-available", 5}
+    errKindStore                = errorKind{"store-error", 6}
+    errKindDownload             = errorKind{"download-failed", 7}
+    errKindAssertion            = errorKind{"assertion-failed", 8}
+    errKindSeed                 = errorKind{"seed-invalid", 9}
+    errKindValidation           = errorKind{"validation-failed", 10}
+    errKindDiskFull             = errorKind{"disk-full", 11}
+    errKindSeedLocked           = errorKind{"seed-locked", 12}
+    errKindRequirements         = errorKind{"requirements-not-met", 13}
+)
+
+// StoreError is a failed store request about a snap
+type StoreError struct {
+    Snap string
+    Err  error
+}
+
+func (e *StoreError) Error() string { return e.Err.Error() }
+func (e *StoreError) Unwrap() error { return e.Err }
+
+// DownloadError is a failed download of a snap or a delta
+type DownloadError struct {
+    Snap string
+    Err  error
+}
+
+func (e *DownloadError) Error() string { return e.Err.Error() }
+func (e *DownloadError) Unwrap() error { return e.Err }
+
+// AssertionError is an assertion that could not be fetched or written
+type AssertionError struct {
+    Snap string
+    Err  error
+}
+
+func (e *AssertionError) Error() string { return e.Err.Error() }
+func (e *AssertionError) Unwrap() error { return e.Err }
+
+// SeedError is a seed.yaml or model that cannot be read or written
+type SeedError struct {
+    Err error
+}
+
+func (e *SeedError) Error() string { return e.Err.Error() }
+func (e *SeedError) Unwrap() error { return e.Err }
+
+// ValidationError is a seed that snap debug validate-seed rejected
+type ValidationError struct {
+    Output string
+    Err    error
+}
+
+func (e *ValidationError) Error() string {
+    return fmt.Sprintf("validation failed with output: %s, error: %v", e.Output, e.Err)
+}
+func (e *ValidationError) Unwrap() error { return e.Err }
+
+// SeedLockedError is a seed held by another snapd-seed-glue process
+type SeedLockedError struct {
+    Err error
+}
+
+func (e *SeedLockedError) Error() string { return e.Err.Error() }
+func (e *SeedLockedError) Unwrap() error { return e.Err }
+
+// RequirementsError is a snap that the model does not allow in the seed
+type RequirementsError struct {
+    Snap string
+    Err  error
+}
+
+func (e *RequirementsError) Error() string { return e.Err.Error() }
+func (e *RequirementsError) Unwrap() error { return e.Err }
+
+// NetworkError is a store request made through the snap command that failed, which only tells
+// that the store could not be asked
+type NetworkError struct {
+    Err error
+}
+
+func (e *NetworkError) Error() string { return e.Err.Error() }
+func (e *NetworkError) Unwrap() error { return e.Err }
+
+// classifyError works out the kind of a failure. What went wrong underneath, a full disk or
+// a missing network, comes before where it went wrong.
+func classifyError(err error) errorKind {
+    var (
+        notAvail    *store.RevisionNotAvailableError
+        actionErr   *store.SnapActionError
+        storeErr    *StoreError
+        downloadErr *DownloadError
+        assertErr   *AssertionError
+        seedErr     *SeedError
+        validErr    *ValidationError
+        lockedErr   *SeedLockedError
+        reqErr      *RequirementsError
+    )
+    switch {
+    case err == nil:
+        return errKindInternal
+    case errors.Is(err, syscall.ENOSPC):
+        return errKindDiskFull
+    case isNetworkError(err):
+        return errKindNetwork
+    case errors.Is(err, store.ErrSnapNotFound):
+        return errKindSnapNotFound
+    case errors.As(err, &notAvail):
+        return errKindRevisionNotAvailable
+    case errors.As(err, &actionErr):
+        return classifySnapActionError(actionErr)
+    case errors.As(err, &reqErr):
+        return errKindRequirements
+    case errors.As(err, &storeErr):
+        return errKindStore
+    case errors.As(err, &downloadErr):
+        return errKindDownload
+    case errors.As(err, &assertErr):
+        return errKindAssertion
+    case errors.As(err, &validErr):
+        return errKindValidation
+    case errors.As(err, &seedErr):
+        return errKindSeed
+    case errors.As(err, &lockedErr):
+        return errKindSeedLocked
+    }
+    return errKindInternal
+}
+
+// isNetworkError reports whether err is the store being out of reach: a host that cannot be looked
+// up, or a connection that cannot be made. A connection that breaks off midway is a failed request,
+// not a missing network. Local sockets such as the progress socket or D-Bus fail with the same error
+// types, but never over TCP.
+func isNetworkError(err error) bool {
+    var (
+        networkErr *NetworkError
+        persistent *httputil.PersistentNetworkError
+        opErr      *net.OpError
+        dnsErr     *net.DNSError
+    )
+    switch {
+    case errors.As(err, &networkErr), errors.As(err, &persistent), errors.As(err, &dnsErr), httputil.NoNetwork(err):
+        return true
+    case errors.As(err, &opErr):
+        return opErr.Op == "dial" && strings.HasPrefix(opErr.Net, "tcp")
+    }
+    return false
+}
+
+// classifySnapActionError looks into the errors the store gave for the single snap of a request,
+// which SnapActionError does not unwrap
+func classifySnapActionError(err *store.SnapActionError) errorKind {
+    if _, _, single := err.SingleOpError(); single != nil {
+        if kind := classifyError(single); kind != errKindInternal {
+            return kind
+        }
+    }
+    for _, other := range err.Other {
+        if kind := classifyError(other); kind != errKindInternal {
+            return kind
+        }
+    }
+    return errKindStore
+}
+
+// errorSnap returns the snap a failure is about, if any
+func errorSnap(err error) string {
+    var (
+        storeErr    *StoreError
+        downloadErr *DownloadError
+        assertErr   *AssertionError
+        reqErr      *RequirementsError
+    )
+    switch {
+    case errors.As(err, &storeErr):
+        return storeErr.Snap
+    case errors.As(err, &downloadErr):
+        return downloadErr.Snap
+    case errors.As(err, &assertErr):
+        return assertErr.Snap
+    case errors.As(err, &reqErr):
+        return reqErr.Snap
+    }
+    return ""
+}
+
+// firstError returns the first error among the arguments of a message
+func firstError(v []interface{}) error {
+    for _, arg := range v {
+        if err, ok := arg.(error); ok {
+            return err
+        }
+    }
+    return nil
+}
+
+// errorReport is the file written with --error-report when a run fails, for installers to
+// show the failure in their own words
+type errorReport struct {
+    ID       string    `json:"id"`
+    ExitCode int       `json:"exit-code"`
+    Message  string    `json:"message"`
+    Details  string    `json:"details,omitempty"`
+    Snap     string    `json:"snap,omitempty"`
+    Phase    string    `json:"phase,omitempty"`
+    Time     time.Time `json:"time"`
+}
+
+// writeErrorReport writes the report of a failure to the file given with --error-report
+func writeErrorReport(kind errorKind, message string, err error) {
+    if errorReportPath == "" {
+        return
+    }
+    report := errorReport{
+        ID:       kind.ID,
+        ExitCode: kind.ExitCode,
+        Message:  message,
+        Phase:    currentPhase(),
+        Time:     time.Now(),
+    }
+    if err != nil {
+        report.Details = err.Error()
+        report.Snap = errorSnap(err)
+    }
+    content, err := json.MarshalIndent(report, "", "  ")
+    if err != nil {
+        return
+    }
+    if err := os.WriteFile(errorReportPath, append(content, '\n'), 0644); err != nil {
+        log.Printf("Failed to write error report %s: %v", errorReportPath, err)
+    }
+}
+
+// currentPhase is the untranslated name of the step the run is in
+func currentPhase() string {
+    if progressTracker == nil {
+        return ""
+    }
+    progressTracker.mu.Lock()
+    defer progressTracker.mu.Unlock()
+    if progressTracker.currentStep >= len(progressTracker.steps) {
+        return ""
+    }
+    return progressTracker.steps[progressTracker.currentStep].Status
+}
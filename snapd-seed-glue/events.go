@@ -0,0 +1,212 @@
+// Copyright (C) 2024 Simon Quigley <tsimonq2@ubuntu.com>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 3
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "io"
+    "sync"
+    "time"
+)
+
+// Progress output formats, auto is a live display on a terminal and tab otherwise
+const (
+    progressFormatAuto  = "auto"
+    progressFormatTab   = "tab"
+    progressFormatJSONL = "jsonl"
+)
+
+// Types of progress events
+const (
+    eventProgress     = "progress"
+    eventPhaseStart   = "phase-start"
+    eventPhaseEnd     = "phase-end"
+    eventResolve      = "resolve"
+    eventDownload     = "download"
+    eventNotification = "notification"
+    eventWarning      = "warning"
+    eventError        = "error"
+    eventSummary      = "summary"
+)
+
+// Results given in the final summary
+const (
+    resultSuccess = "success"
+    resultFailure = "failure"
+)
+
+// downloadEventInterval limits how often download progress is sent for a single snap
+const downloadEventInterval = 250 * time.Millisecond
+
+// progressEvent is a single structured progress event
+type progressEvent struct {
+    Type    string    `json:"event"`
+    Time    time.Time `json:"time"`
+    Percent int       `json:"percent"`
+    Phase   string    `json:"phase,omitempty"`
+    Message string    `json:"message,omitempty"`
+    // ErrorID is the stable ID of the kind of failure, set for errors
+    ErrorID string `json:"error-id,omitempty"`
+
+    // Set for events about a single snap
+    Snap     string `json:"snap,omitempty"`
+    Revision string `json:"revision,omitempty"`
+    Channel  string `json:"channel,omitempty"`
+    // Method is delta or full for downloads
+    Method string `json:"method,omitempty"`
+
+    // Set for download progress. Rate is a moving average in bytes per second, ETA and ETATotal
+    // are the seconds left for this download and for all downloads.
+    Bytes    int64   `json:"bytes,omitempty"`
+    Total    int64   `json:"total,omitempty"`
+    Rate     float64 `json:"rate,omitempty"`
+    ETA      float64 `json:"eta,omitempty"`
+    ETATotal float64 `json:"eta-total,omitempty"`
+
+    // Set for the final summary
+    Result     string     `json:"result,omitempty"`
+    Downloaded int        `json:"downloaded,omitempty"`
+    Removed    int        `json:"removed,omitempty"`
+    Elapsed    float64    `json:"elapsed,omitempty"`
+    Snaps      []snapStat `json:"snaps,omitempty"`
+}
+
+// EventReporter is implemented by progress reporters that take structured events
+type EventReporter interface {
+    Event(event progressEvent)
+}
+
+// JSONLinesProgressReporter writes every progress update and event as a line of JSON
+type JSONLinesProgressReporter struct {
+    mu     sync.Mutex
+    output io.Writer
+}
+
+// NewJSONLinesProgressReporter creates a reporter writing to output
+func NewJSONLinesProgressReporter(output io.Writer) *JSONLinesProgressReporter {
+    return &JSONLinesProgressReporter{output: output}
+}
+
+func (j *JSONLinesProgressReporter) Report(percentage int, status string) {
+    j.Event(progressEvent{Type: eventProgress, Percent: percentage, Message: status})
+}
+
+func (j *JSONLinesProgressReporter) Event(event progressEvent) {
+    if event.Time.IsZero() {
+        event.Time = time.Now()
+    }
+    content, err := json.Marshal(event)
+    if err != nil {
+        return
+    }
+    j.mu.Lock()
+    defer j.mu.Unlock()
+    fmt.Fprintf(j.output, "%s\n", content)
+}
+
+// emitEvent passes an event to the progress reporter if it takes structured events.
+// It returns false if the event was not consumed, so the caller can fall back to plain output.
+func emitEvent(event progressEvent) bool {
+    reporter, ok := progressReporter.(EventReporter)
+    if !ok {
+        return false
+    }
+    if event.Percent == 0 {
+        event.Percent = currentPercentage()
+    }
+    reporter.Event(event)
+
+    // Listeners take every event, the plain output still needs it unless its own reporter took it
+    if fanout, ok := progressReporter.(*fanoutProgressReporter); ok {
+        _, structured := fanout.primary.(EventReporter)
+        return structured
+    }
+    return true
+}
+
+// fanoutProgressReporter passes progress to the reporter of the progress output and to listeners
+// such as the progress socket
+type fanoutProgressReporter struct {
+    primary   ProgressReporter
+    listeners []EventReporter
+}
+
+func (f *fanoutProgressReporter) Report(percentage int, status string) {
+    f.primary.Report(percentage, status)
+    for _, listener := range f.listeners {
+        listener.Event(progressEvent{Type: eventProgress, Time: time.Now(), Percent: percentage, Message: status})
+    }
+}
+
+func (f *fanoutProgressReporter) Event(event progressEvent) {
+    if event.Time.IsZero() {
+        event.Time = time.Now()
+    }
+    if primary, ok := f.primary.(EventReporter); ok {
+        primary.Event(event)
+    }
+    for _, listener := range f.listeners {
+        listener.Event(event)
+    }
+}
+
+// currentPercentage is the overall progress last reported
+func currentPercentage() int {
+    if progressTracker == nil {
+        return 0
+    }
+    progressTracker.mu.Lock()
+    defer progressTracker.mu.Unlock()
+    return progressTracker.calculatePercentage()
+}
+
+// runSummary counts what a run did, for the final summary event
+var runSummary struct {
+    started    time.Time
+    downloaded int
+    removed    int
+    // applying is set once the run starts changing the seed, from then on the summary lists every snap
+    applying   bool
+}
+
+// emitSummary sends the final summary event
+func emitSummary(result, message string) {
+    elapsed := 0.0
+    if !runSummary.started.IsZero() {
+        elapsed = time.Since(runSummary.started).Seconds()
+    }
+    globalMu.Lock()
+    downloadedBytes := int64(globalDownloaded)
+    globalMu.Unlock()
+
+    percent := currentPercentage()
+    if result == resultSuccess {
+        percent = 100
+    }
+    var stats []snapStat
+    if runSummary.applying {
+        stats = buildSnapStats()
+    }
+    emitEvent(progressEvent{
+        Type:       eventSummary,
+        Percent:    percent,
+        Message:    message,
+        Result:     result,
+        Downloaded: runSummary.downloaded,
+        Removed:    runSummary.removed,
+        Bytes:      downloadedBytes,
+        Elapsed:    elapsed,
+        Snaps:      stats,
+    })
+}
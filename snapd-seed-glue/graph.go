@@ -0,0 +1,157 @@
+// Copyright (C) 2024 Simon Quigley <tsimonq2@ubuntu.com>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 3
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "sort"
+    "strings"
+
+    "github.com/snapcore/snapd/snap"
+    "github.com/snapcore/snapd/strutil"
+)
+
+// Roles a snap plays in the dependency graph
+const (
+    roleSnapd     = "snapd"
+    roleRequested = "requested"
+    roleBase      = "base"
+    roleContent   = "content-provider"
+)
+
+// graphNode is a snap of the resolved seed
+type graphNode struct {
+    Name     string        `json:"name"`
+    Role     string        `json:"role"`
+    Type     string        `json:"type,omitempty"`
+    Channel  string        `json:"channel,omitempty"`
+    Revision snap.Revision `json:"revision"`
+    Size     int64         `json:"size"`
+}
+
+// graphEdge is a dependency between two snaps of the resolved seed
+type graphEdge struct {
+    From string   `json:"from"`
+    To   string   `json:"to"`
+    Kind string   `json:"kind"`
+    Tags []string `json:"tags,omitempty"`
+}
+
+// seedGraph is the dependency graph of the resolved seed
+type seedGraph struct {
+    Nodes []graphNode `json:"nodes"`
+    Edges []graphEdge `json:"edges"`
+}
+
+// buildSeedGraph builds the dependency graph from the snaps and edges found while resolving the seed
+func buildSeedGraph() seedGraph {
+    graph := seedGraph{Nodes: []graphNode{}, Edges: []graphEdge{}}
+
+    baseSnaps := make(map[string]bool)
+    seenEdges := make(map[string]bool)
+    for _, dep := range snapDependencies {
+        key := dep.From + "\x00" + dep.To + "\x00" + dep.Kind
+        if seenEdges[key] {
+            continue
+        }
+        seenEdges[key] = true
+        if dep.Kind == dependencyBase {
+            baseSnaps[dep.To] = true
+        }
+        graph.Edges = append(graph.Edges, graphEdge{From: dep.From, To: dep.To, Kind: dep.Kind, Tags: dep.Tags})
+    }
+
+    for _, current := range currentSnaps {
+        if !requiredSnaps[current.InstanceName] {
+            continue
+        }
+        node := graphNode{
+            Name:     current.InstanceName,
+            Channel:  strings.Replace(current.TrackingChannel, "latest/", "", -1),
+            Revision: current.Revision,
+        }
+        info := snapInfoMap[node.Name]
+        if info != nil {
+            node.Type = string(info.Type())
+            node.Size = info.Size
+        }
+        // The type decides first, snapd and bare are requested by default but are not apps
+        switch {
+        case node.Name == "snapd" || (info != nil && info.Type() == snap.TypeSnapd):
+            node.Role = roleSnapd
+        case info != nil && (info.Type() == snap.TypeBase || info.Type() == snap.TypeOS):
+            node.Role = roleBase
+        case requestedSnaps[node.Name]:
+            node.Role = roleRequested
+        case baseSnaps[node.Name]:
+            node.Role = roleBase
+        default:
+            node.Role = roleContent
+        }
+        graph.Nodes = append(graph.Nodes, node)
+    }
+
+    sort.Slice(graph.Nodes, func(i, j int) bool {
+        return graph.Nodes[i].Name < graph.Nodes[j].Name
+    })
+    sort.Slice(graph.Edges, func(i, j int) bool {
+        if graph.Edges[i].From != graph.Edges[j].From {
+            return graph.Edges[i].From < graph.Edges[j].From
+        }
+        return graph.Edges[i].To < graph.Edges[j].To
+    })
+    return graph
+}
+
+// renderGraphJSON renders the graph as JSON
+func renderGraphJSON(graph seedGraph) ([]byte, error) {
+    content, err := json.MarshalIndent(graph, "", "  ")
+    if err != nil {
+        return nil, fmt.Errorf("failed to encode graph: %w", err)
+    }
+    return append(content, '\n'), nil
+}
+
+// renderGraphDot renders the graph in Graphviz DOT format
+func renderGraphDot(graph seedGraph) []byte {
+    shapes := map[string]string{
+        roleSnapd:     "doubleoctagon",
+        roleRequested: "box",
+        roleBase:      "ellipse",
+        roleContent:   "component",
+    }
+
+    var b strings.Builder
+    fmt.Fprintf(&b, "digraph seed {\n")
+    for _, node := range graph.Nodes {
+        label := fmt.Sprintf("%s\nrevision %s\n%s", node.Name, node.Revision, strutil.SizeToStr(node.Size))
+        fmt.Fprintf(&b, "    %s [label=%s, shape=%s, role=%s, revision=%s, size=%d];\n",
+            dotQuote(node.Name), dotQuote(label), shapes[node.Role], dotQuote(node.Role), dotQuote(node.Revision.String()), node.Size)
+    }
+    for _, edge := range graph.Edges {
+        label := edge.Kind
+        if len(edge.Tags) > 0 {
+            label = fmt.Sprintf("%s: %s", edge.Kind, strings.Join(edge.Tags, ", "))
+        }
+        fmt.Fprintf(&b, "    %s -> %s [label=%s];\n", dotQuote(edge.From), dotQuote(edge.To), dotQuote(label))
+    }
+    fmt.Fprintf(&b, "}\n")
+    return []byte(b.String())
+}
+
+// dotQuote quotes a DOT identifier. Backslashes are escaped before the quotes and line breaks,
+// so the escapes it adds are the only ones.
+func dotQuote(s string) string {
+    return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
@@ -0,0 +1,100 @@
+// Copyright (C) 2024 Simon Quigley <tsimonq2@ubuntu.com>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 3
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+package main
+
+//go:generate sh po/update-pot
+
+import (
+    "os"
+    "strings"
+
+    "github.com/snapcore/go-gettext"
+)
+
+// textDomain is the gettext domain of our messages
+const textDomain = "snapd-seed-glue"
+
+// localeDir holds the message catalogs, as <locale>/LC_MESSAGES/snapd-seed-glue.mo
+var localeDir = "/usr/share/locale"
+
+// catalog translates the messages, until initLocale loads it they stay untranslated
+var catalog gettext.Catalog
+
+// initLocale loads the message catalog for the locale of the environment
+func initLocale() {
+    translations := gettext.NewTranslations(localeDir, textDomain, gettext.DefaultResolver)
+    for _, locale := range localeCandidates(localeFromEnv()) {
+        if _, err := os.Stat(gettext.DefaultResolver(localeDir, locale, textDomain)); err == nil {
+            catalog = translations.Locale(locale)
+            return
+        }
+    }
+}
+
+// localeFromEnv finds the locale of messages the way gettext does: LC_ALL, LC_MESSAGES and LANG
+// in that order, with the first language of LANGUAGE taking over unless the locale is C
+func localeFromEnv() string {
+    locale := ""
+    for _, name := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+        if locale = os.Getenv(name); locale != "" {
+            break
+        }
+    }
+    if locale == "" || locale == "C" || locale == "POSIX" || strings.HasPrefix(locale, "C.") {
+        return ""
+    }
+    if language := strings.Split(os.Getenv("LANGUAGE"), ":")[0]; language != "" {
+        locale = language
+    }
+    return locale
+}
+
+// localeCandidates lists the catalogs to try for a locale such as de_DE.UTF-8@euro, most specific first
+func localeCandidates(locale string) []string {
+    if locale == "" {
+        return nil
+    }
+    if i := strings.IndexAny(locale, ".@"); i >= 0 {
+        locale = locale[:i]
+    }
+    candidates := []string{locale}
+    if i := strings.Index(locale, "_"); i > 0 {
+        candidates = append(candidates, locale[:i])
+    }
+    return candidates
+}
+
+// G translates a message
+func G(msgid string) string {
+    if catalog == nil {
+        return msgid
+    }
+    return catalog.Gettext(msgid)
+}
+
+// NG translates a message with a singular and a plural form, picking the form for n
+func NG(msgid, msgidPlural string, n int) string {
+    if catalog == nil {
+        if n == 1 {
+            return msgid
+        }
+        return msgidPlural
+    }
+    return catalog.NGettext(msgid, msgidPlural, uint32(n))
+}
+
+// N_ marks a message for translation without translating it, for strings that are
+// also used untranslated such as phase names in progress events
+func N_(msgid string) string {
+    return msgid
+}
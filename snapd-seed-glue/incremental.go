@@ -0,0 +1,119 @@
+// Copyright (C) 2024 Simon Quigley <tsimonq2@ubuntu.com>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 3
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+package main
+
+import (
+    "path/filepath"
+
+    "github.com/snapcore/snapd/snap"
+)
+
+var (
+    // dependencySnaps are seed entries that are only there for other snaps, such as bases and content providers
+    dependencySnaps = make(map[string]bool)
+    // removalReasons explains why each snap leaving the seed is removed
+    removalReasons = make(map[string]string)
+)
+
+// incrementalRoots returns the snaps of the existing seed that should stay requested in incremental mode,
+// as name or name=channel entries. These are the snaps recorded as requested. For a seed written before
+// they were recorded, bases and content providers are left out instead. Everything else stays only as
+// long as something still needs it. Unasserted snaps are kept by adding their seed copy to localSnapPaths.
+func incrementalRoots(snapsDir string, removeSnaps map[string]bool) ([]string, error) {
+    versionID, err := getVersionID()
+    if err != nil {
+        return nil, err
+    }
+    defaultChannels := map[string]bool{
+        "":                           true,
+        "stable":                     true,
+        "stable/ubuntu-" + versionID: true,
+    }
+
+    var roots []string
+    if !fileExists(seedYaml) {
+        return roots, nil
+    }
+    requested, recorded := loadRequestedSnaps()
+    for _, entry := range loadSeedData().Snaps {
+        if removeSnaps[entry.Name] {
+            removalReasons[entry.Name] = "removed with --remove"
+            continue
+        }
+
+        snapPath := filepath.Join(snapsDir, entry.File)
+        if recorded {
+            if !requested[entry.Name] {
+                verboseLog("Treating %s as a dependency of other snaps", entry.Name)
+                dependencySnaps[entry.Name] = true
+                continue
+            }
+        } else if info, err := readSnapFileInfo(snapPath); err != nil {
+            // Without snap.yaml we cannot tell what the snap is for, so keep it
+            verboseLog("Keeping %s as requested: %v", entry.Name, err)
+        } else if isDependencySnap(info) {
+            verboseLog("Treating %s as a dependency of other snaps", entry.Name)
+            dependencySnaps[entry.Name] = true
+            continue
+        }
+
+        switch {
+        case entry.Unasserted:
+            localSnapPaths = append(localSnapPaths, snapPath)
+        case defaultChannels[entry.Channel]:
+            roots = append(roots, entry.Name)
+        default:
+            roots = append(roots, entry.Name+"="+entry.Channel)
+        }
+    }
+    return roots, nil
+}
+
+// isDependencySnap guesses whether a snap is only seeded because another snap needs it,
+// for seeds that do not record the requested snaps
+func isDependencySnap(info *snap.Info) bool {
+    if info.Type() != snap.TypeApp {
+        return true
+    }
+    for _, slot := range info.Slots {
+        if slot.Interface == "content" {
+            return true
+        }
+    }
+    return false
+}
+
+// explainRemovals records and reports why each snap that is no longer required leaves the seed
+func explainRemovals(removeSnaps map[string]bool) {
+    for name := range removeSnaps {
+        if requiredSnaps[name] {
+            warnf("Cannot remove %s, other snaps in the seed still need it", name)
+            delete(removalReasons, name)
+        } else if removalReasons[name] == "" {
+            warnf("Cannot remove %s, it is not in the seed", name)
+        }
+    }
+
+    _, droppedSnaps := splitRequiredSnaps()
+    for _, dropped := range droppedSnaps {
+        name := dropped.InstanceName
+        if removalReasons[name] != "" {
+            continue
+        }
+        if dependencySnaps[name] {
+            removalReasons[name] = "nothing left in the seed uses it as a base or content provider"
+        } else {
+            removalReasons[name] = "not requested"
+        }
+    }
+}
@@ -0,0 +1,275 @@
+// Copyright (C) 2024 Simon Quigley <tsimonq2@ubuntu.com>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 3
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+package main
+
+import (
+    "bufio"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+
+    "github.com/snapcore/snapd/snap"
+)
+
+// Severities of lint findings, only errors make lint fail
+const (
+    severityError   = "error"
+    severityWarning = "warning"
+    severityInfo    = "info"
+)
+
+// eolBases are bases that no longer get security updates
+var eolBases = map[string]bool{
+    "core":   true,
+    "core18": true,
+}
+
+// lintFinding is a single problem found in a seed
+type lintFinding struct {
+    Severity string `json:"severity"`
+    Check    string `json:"check"`
+    Snap     string `json:"snap,omitempty"`
+    Message  string `json:"message"`
+}
+
+// lintReport is the result of linting a seed
+type lintReport struct {
+    Seed     string        `json:"seed"`
+    Errors   int           `json:"errors"`
+    Warnings int           `json:"warnings"`
+    Findings []lintFinding `json:"findings"`
+}
+
+// add records a finding
+func (r *lintReport) add(severity, check, snapName, format string, v ...interface{}) {
+    r.Findings = append(r.Findings, lintFinding{
+        Severity: severity,
+        Check:    check,
+        Snap:     snapName,
+        Message:  fmt.Sprintf(format, v...),
+    })
+    switch severity {
+    case severityError:
+        r.Errors++
+    case severityWarning:
+        r.Warnings++
+    }
+}
+
+// lintSeed inspects the seed directory without changing it or contacting the store
+func lintSeed(seedDir string) (*lintReport, error) {
+    report := &lintReport{Seed: seedDir, Findings: []lintFinding{}}
+    snapsDir := filepath.Join(seedDir, "snaps")
+    assertionsDir := filepath.Join(seedDir, "assertions")
+    seedYaml = filepath.Join(seedDir, "seed.yaml")
+    if !fileExists(seedYaml) {
+        return nil, fmt.Errorf("%s has no seed.yaml", seedDir)
+    }
+
+    versionID, err := getVersionID()
+    if err != nil {
+        return nil, err
+    }
+    branch := "stable/ubuntu-" + versionID
+
+    seedData := loadSeedData()
+    infos := make(map[string]*snap.Info)
+    for _, entry := range seedData.Snaps {
+        info, err := readSnapFileInfo(filepath.Join(snapsDir, entry.File))
+        if err != nil {
+            report.add(severityError, "snap-file", entry.Name, "cannot read %s: %v", entry.File, err)
+            continue
+        }
+        infos[entry.Name] = info
+    }
+
+    for _, entry := range seedData.Snaps {
+        if entry.DevMode {
+            report.add(severityWarning, "devmode", entry.Name, "is seeded in devmode")
+        }
+        if entry.Unasserted {
+            report.add(severityWarning, "dangerous", entry.Name, "is unasserted, which needs a model with grade dangerous")
+        } else {
+            if entry.Channel != branch {
+                report.add(severityWarning, "channel", entry.Name, "tracks %s instead of %s", describeSeedChannel(entry.Channel), branch)
+            }
+            lintAssertions(report, entry, snapsDir, assertionsDir)
+        }
+
+        info := infos[entry.Name]
+        if info == nil {
+            continue
+        }
+        if info.Confinement == snap.DevModeConfinement && !entry.DevMode {
+            report.add(severityWarning, "devmode", entry.Name, "has devmode confinement")
+        }
+        if eolBases[info.Base] {
+            report.add(severityWarning, "eol-base", entry.Name, "uses base %s, which has reached end of life", info.Base)
+        }
+        if info.Base != "" && infos[info.Base] == nil {
+            report.add(severityError, "missing-base", entry.Name, "needs base %s, which is not in the seed", info.Base)
+        }
+        for _, plug := range contentPlugs(info) {
+            if seedProvidesContent(infos, plug.Tag) {
+                continue
+            }
+            // Only a provider the snap declares and the seed was meant to have is an error
+            provider := contentProvider(entry.Name, plug.Tag, plug.Provider)
+            switch {
+            case provider == "":
+                report.add(severityWarning, "missing-provider", entry.Name, "has an optional content plug for %s that no snap in the seed provides", plug.Tag)
+            case excludedProviders[provider]:
+                report.add(severityWarning, "missing-provider", entry.Name, "has a content plug for %s that no snap in the seed provides, its provider %s is excluded", plug.Tag, provider)
+            default:
+                report.add(severityError, "missing-provider", entry.Name, "has a content plug for %s that no snap in the seed provides, not even its provider %s", plug.Tag, provider)
+            }
+        }
+    }
+
+    for _, stale := range staleSeedFiles(snapsDir, assertionsDir, seedData) {
+        relPath, err := filepath.Rel(seedDir, stale)
+        if err != nil {
+            relPath = stale
+        }
+        report.add(severityWarning, "unreferenced-file", "", "%s is not referenced by seed.yaml", relPath)
+    }
+    if len(report.Findings) == 0 {
+        report.add(severityInfo, "summary", "", "no problems found")
+    }
+    return report, nil
+}
+
+// lintAssertions checks that the snap-revision assertion of a seed entry matches its snap file
+func lintAssertions(report *lintReport, entry *seedSnap, snapsDir, assertionsDir string) {
+    revision := extractRevisionFromFile(entry.File)
+    assertPath := filepath.Join(assertionsDir, fmt.Sprintf("%s_%s.assert", entry.Name, revision))
+    assertedRevision, assertedSha, err := readSnapRevisionAssertion(assertPath)
+    if err != nil {
+        report.add(severityError, "assertion", entry.Name, "has no usable snap-revision assertion: %v", err)
+        return
+    }
+    if strconv.Itoa(assertedRevision) != revision {
+        report.add(severityError, "assertion", entry.Name, "snap-revision assertion is for revision %d, but the snap file has revision %s", assertedRevision, revision)
+        return
+    }
+
+    fileSha, err := fileSha3_384(filepath.Join(snapsDir, entry.File))
+    if err != nil {
+        report.add(severityError, "assertion", entry.Name, "cannot checksum %s: %v", entry.File, err)
+        return
+    }
+    digest, err := hex.DecodeString(fileSha)
+    if err != nil || base64.RawURLEncoding.EncodeToString(digest) != assertedSha {
+        report.add(severityError, "assertion", entry.Name, "snap-revision assertion does not match %s", entry.File)
+    }
+}
+
+// readSnapRevisionAssertion reads the revision and base64 SHA3-384 from the snap-revision assertion in an .assert file
+func readSnapRevisionAssertion(assertPath string) (int, string, error) {
+    file, err := os.Open(assertPath)
+    if err != nil {
+        return 0, "", err
+    }
+    defer file.Close()
+
+    revision := 0
+    sha := ""
+    scanner := bufio.NewScanner(file)
+    for scanner.Scan() {
+        line := strings.TrimSpace(scanner.Text())
+        if value, found := strings.CutPrefix(line, "snap-revision:"); found {
+            if revision, err = strconv.Atoi(strings.TrimSpace(value)); err != nil {
+                return 0, "", fmt.Errorf("invalid snap-revision in %s: %w", assertPath, err)
+            }
+        }
+        if value, found := strings.CutPrefix(line, "snap-sha3-384:"); found {
+            sha = strings.TrimSpace(value)
+        }
+    }
+    if err := scanner.Err(); err != nil {
+        return 0, "", err
+    }
+    if revision == 0 || sha == "" {
+        return 0, "", fmt.Errorf("%s has no snap-revision assertion", filepath.Base(assertPath))
+    }
+    return revision, sha, nil
+}
+
+// contentPlugs returns the content tags of the content plugs of a snap, with the snap declared as
+// their default-provider if any
+func contentPlugs(info *snap.Info) []contentTag {
+    var plugs []contentTag
+    for _, plug := range info.Plugs {
+        if plug.Interface != "content" {
+            continue
+        }
+        // The content attribute defaults to the plug name
+        content, ok := plug.Attrs["content"].(string)
+        if !ok {
+            content = plug.Name
+        }
+        // The default-provider may name the slot after the snap
+        provider, _ := plug.Attrs["default-provider"].(string)
+        provider, _, _ = strings.Cut(provider, ":")
+        plugs = append(plugs, contentTag{Snap: info.InstanceName(), Tag: content, Provider: provider})
+    }
+    sort.Slice(plugs, func(i, j int) bool {
+        return plugs[i].Tag < plugs[j].Tag
+    })
+    return plugs
+}
+
+// seedProvidesContent checks whether any of the given snaps has a content slot for the tag
+func seedProvidesContent(infos map[string]*snap.Info, tag string) bool {
+    for _, info := range infos {
+        if providesContent(info, tag) {
+            return true
+        }
+    }
+    return false
+}
+
+// describeSeedChannel names a seed.yaml channel, which is empty for snaps without one
+func describeSeedChannel(channel string) string {
+    if channel == "" {
+        return "no channel"
+    }
+    return channel
+}
+
+// printLintReport prints the findings one per line, followed by a summary
+func printLintReport(report *lintReport) {
+    for _, finding := range report.Findings {
+        if finding.Snap != "" {
+            fmt.Printf("%s: %s: %s %s\n", finding.Severity, finding.Check, finding.Snap, finding.Message)
+        } else {
+            fmt.Printf("%s: %s: %s\n", finding.Severity, finding.Check, finding.Message)
+        }
+    }
+    fmt.Printf("%d errors, %d warnings\n", report.Errors, report.Warnings)
+}
+
+// writeLintReportJSON prints the report as JSON
+func writeLintReportJSON(report *lintReport) error {
+    content, err := json.MarshalIndent(report, "", "  ")
+    if err != nil {
+        return fmt.Errorf("failed to encode lint report: %w", err)
+    }
+    return writeOutput("-", append(content, '\n'))
+}
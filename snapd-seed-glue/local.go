@@ -0,0 +1,118 @@
+// Copyright (C) 2024 Simon Quigley <tsimonq2@ubuntu.com>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 3
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+package main
+
+import (
+    "fmt"
+    "path/filepath"
+
+    "github.com/snapcore/snapd/asserts"
+    "github.com/snapcore/snapd/snap"
+    "github.com/snapcore/snapd/snap/squashfs"
+    "github.com/snapcore/snapd/store"
+)
+
+// localRevision is the revision given to unasserted snaps, which makes their seed file name_x1.snap
+var localRevision = snap.R(-1)
+
+// readSnapFileInfo reads meta/snap.yaml from a snap file
+func readSnapFileInfo(snapPath string) (*snap.Info, error) {
+    info, err := snap.ReadInfoFromSnapFile(squashfs.New(snapPath), nil)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read snap.yaml from %s: %w", snapPath, err)
+    }
+    return info, nil
+}
+
+// collectLocalSnaps reads the given local snap files and collects them together with the store snaps they depend on.
+func collectLocalSnaps(snapPaths []string, channel, fallbackChannel, snapsDir, assertionsDir string) ([]SnapDetails, error) {
+    var snapDetailsList []SnapDetails
+    if len(snapPaths) == 0 {
+        return snapDetailsList, nil
+    }
+
+    // Unasserted snaps are only allowed by models without a grade or with grade dangerous
+    if grade := seedModel.Grade(); grade != asserts.ModelGradeUnset && grade != asserts.ModelDangerous {
+        return nil, fmt.Errorf("cannot seed local snaps: model %s/%s has grade %s, unasserted snaps need grade dangerous", seedModel.BrandID(), seedModel.Model(), grade)
+    }
+
+    for _, snapPath := range snapPaths {
+        info, err := readSnapFileInfo(snapPath)
+        if err != nil {
+            return nil, err
+        }
+        snapName := info.SnapName()
+        verboseLog("Local snap %s: name %s, version %s, base %s", snapPath, snapName, info.Version, info.Base)
+
+        if processedSnaps[snapName] {
+            // A snap kept from the seed gives way to a new local build given with --local-snap
+            if filepath.Dir(snapPath) == snapsDir {
+                continue
+            }
+            return nil, fmt.Errorf("local snap %s is given more than once", snapName)
+        }
+        if err := checkConfinement(info); err != nil {
+            return nil, err
+        }
+
+        newSnap := &store.CurrentSnap{
+            InstanceName: snapName,
+            Revision:     localRevision,
+        }
+        if snapInCurrentSnaps, oldRevision := isSnapInCurrentSnaps(snapName); snapInCurrentSnaps {
+            removeSnapFromCurrentSnaps(snapName, oldRevision)
+        }
+        currentSnaps = append(currentSnaps, newSnap)
+        processedSnaps[snapName] = true
+        requiredSnaps[snapName] = true
+        requestedSnaps[snapName] = true
+        localSnaps[snapName] = true
+        snapInfoMap[snapName] = info
+        emitEvent(progressEvent{
+            Type:     eventResolve,
+            Snap:     snapName,
+            Revision: localRevision.String(),
+            Method:   methodLocal,
+            Message:  "local snap " + snapPath,
+        })
+
+        snapDetailsList = append(snapDetailsList, SnapDetails{
+            InstanceName: snapName,
+            CurrentSnap:  newSnap,
+            LocalPath:    snapPath,
+        })
+
+        // The base and content providers still come from the store
+        prereqDetails, err := collectSnapPrereqs(snapName, info, channel, fallbackChannel, snapsDir, assertionsDir)
+        if err != nil {
+            return nil, err
+        }
+        snapDetailsList = append(snapDetailsList, prereqDetails...)
+    }
+
+    return snapDetailsList, nil
+}
+
+// copyLocalSnap copies an unasserted snap into the snaps directory
+func copyLocalSnap(snapDetails SnapDetails, snapsDir string) error {
+    targetPath := filepath.Join(snapsDir, fmt.Sprintf("%s_%s.snap", snapDetails.InstanceName, localRevision))
+    if sameFile(snapDetails.LocalPath, targetPath) {
+        // Kept from the existing seed, which the working copy links to
+        return nil
+    }
+    if err := copyFile(snapDetails.LocalPath, targetPath); err != nil {
+        return fmt.Errorf("failed to copy local snap %s: %w", snapDetails.InstanceName, err)
+    }
+    verboseLog("Copied local snap %s to %s", snapDetails.LocalPath, targetPath)
+    return nil
+}
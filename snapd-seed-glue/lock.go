@@ -0,0 +1,163 @@
+// Copyright (C) 2024 Simon Quigley <tsimonq2@ubuntu.com>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 3
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+package main
+
+import (
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "time"
+
+    "golang.org/x/sys/unix"
+)
+
+// lockPollInterval is how often a waiting process retries the seed lock
+const lockPollInterval = 250 * time.Millisecond
+
+// seedLock is a flock on a lock file next to the seed directory, exclusive for runs that change
+// the seed and shared for runs that only read it. The lock file sits beside the seed rather than
+// inside it, so it survives the seed being swapped. Only the exclusive holder records its PID.
+type seedLock struct {
+    file   *os.File
+    path   string
+    shared bool
+}
+
+// seedLockPath returns the lock file guarding a seed directory
+func seedLockPath(seedDir string) string {
+    return seedDir + ".lock"
+}
+
+// acquireSeedLock takes the seed lock, shared or exclusive. If wait is set it retries until the
+// lock is free or timeout has passed, a zero timeout waiting forever.
+func acquireSeedLock(seedDir string, shared, wait bool, timeout time.Duration) (*seedLock, error) {
+    path := seedLockPath(seedDir)
+    if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+        return nil, fmt.Errorf("failed to create directory for lock file %s: %w", path, err)
+    }
+    file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+    if err != nil {
+        return nil, fmt.Errorf("failed to open lock file %s: %w", path, err)
+    }
+
+    how := unix.LOCK_EX
+    if shared {
+        how = unix.LOCK_SH
+    }
+    deadline := time.Now().Add(timeout)
+    reportedHolder := -1
+    for {
+        err := unix.Flock(int(file.Fd()), how|unix.LOCK_NB)
+        if err == nil {
+            break
+        }
+        if !errors.Is(err, unix.EWOULDBLOCK) {
+            file.Close()
+            return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+        }
+
+        holder := readLockHolder(file)
+        if !wait || (timeout > 0 && time.Now().After(deadline)) {
+            file.Close()
+            reason := fmt.Sprintf("seed %s is locked by another snapd-seed-glue process%s", seedDir, describeLockHolder(holder))
+            if wait {
+                return nil, &SeedLockedError{Err: fmt.Errorf("timed out after %s waiting for the lock: %s", timeout, reason)}
+            }
+            return nil, &SeedLockedError{Err: fmt.Errorf("%s, use --wait to wait for it", reason)}
+        }
+        if holder != reportedHolder {
+            progressReporter.Report(0, fmt.Sprintf(G("Waiting for another snapd-seed-glue process%s..."), describeLockHolder(holder)))
+            reportedHolder = holder
+        }
+        time.Sleep(lockPollInterval)
+    }
+
+    lock := &seedLock{file: file, path: path, shared: shared}
+    if shared {
+        verboseLog("Acquired shared seed lock %s", path)
+        return lock, nil
+    }
+
+    // We hold the lock, so a PID left in the file belongs to a process that died without cleaning up
+    if holder := readLockHolder(file); holder > 0 && holder != os.Getpid() {
+        verboseLog("Taking over stale lock %s left by PID %d", path, holder)
+    }
+
+    if err := lock.writeHolder(os.Getpid()); err != nil {
+        lock.Release()
+        return nil, fmt.Errorf("failed to record PID in lock file %s: %w", path, err)
+    }
+    verboseLog("Acquired seed lock %s", path)
+    return lock, nil
+}
+
+// Release clears the recorded PID and drops the lock
+func (l *seedLock) Release() {
+    if l.shared {
+        unix.Flock(int(l.file.Fd()), unix.LOCK_UN)
+        l.file.Close()
+        return
+    }
+    if err := l.writeHolder(0); err != nil {
+        verboseLog("Failed to clear lock file %s: %v", l.path, err)
+    }
+    unix.Flock(int(l.file.Fd()), unix.LOCK_UN)
+    l.file.Close()
+}
+
+// writeHolder records the PID holding the lock, or empties the file for a zero PID
+func (l *seedLock) writeHolder(pid int) error {
+    if err := l.file.Truncate(0); err != nil {
+        return err
+    }
+    if pid == 0 {
+        return nil
+    }
+    _, err := l.file.WriteAt([]byte(fmt.Sprintf("%d\n", pid)), 0)
+    return err
+}
+
+// readLockHolder returns the PID recorded in the lock file, or 0 if there is none
+func readLockHolder(file *os.File) int {
+    content, err := io.ReadAll(io.NewSectionReader(file, 0, 64))
+    if err != nil {
+        return 0
+    }
+    pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+    if err != nil {
+        return 0
+    }
+    return pid
+}
+
+// describeLockHolder formats the lock holder for messages. Shared holders record no PID, and a PID
+// that is no longer running is stale, so in both cases the holder is unknown.
+func describeLockHolder(pid int) string {
+    if pid <= 0 {
+        return ""
+    }
+    if !processAlive(pid) {
+        return fmt.Sprintf(" (unknown holder, the recorded PID %d is stale)", pid)
+    }
+    return fmt.Sprintf(" (PID %d)", pid)
+}
+
+// processAlive checks whether a process with the given PID exists
+func processAlive(pid int) bool {
+    err := unix.Kill(pid, 0)
+    return err == nil || errors.Is(err, unix.EPERM)
+}
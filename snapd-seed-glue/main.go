@@ -14,12 +14,17 @@ package main
 
 import (
     "context"
+    "errors"
     "flag"
     "log"
     "fmt"
+    "os"
     "path/filepath"
     "strings"
+    "syscall"
+    "time"
 
+    "github.com/snapcore/snapd/asserts"
     "github.com/snapcore/snapd/snap"
     "github.com/snapcore/snapd/store"
 )
@@ -32,10 +37,59 @@ var (
     requiredSnaps  map[string]bool
     processedSnaps = make(map[string]bool)
     snapSizeMap    = make(map[string]float64)
+    snapInfoMap    = make(map[string]*snap.Info)
+    seedModel      *asserts.Model
+    localSnaps     = make(map[string]bool)
+    localSnapPaths stringList
     totalSnapSize  float64
     seedYaml       string
+    // activeTransaction holds the staged seed changes of the current run, if any
+    activeTransaction *seedTransaction
 )
 
+// Command-line options
+var (
+    seedDirectory  string
+    rollback       bool
+    discardPrevious bool
+    dryRun         bool
+    waitForLock    bool
+    lockTimeout    time.Duration
+    planOutput     string
+    planInput      string
+    graphFormat    string
+    graphOutput    string
+    reportFormat   string
+    progressFormat string
+    progressSocket string
+    dbusBus        string
+    summaryFormat  string
+    // errorReportPath is where a failed run writes its error report
+    errorReportPath string
+    strictAssumes  bool
+    incremental    bool
+    removeSnaps    stringList
+)
+
+// commandNames lists the commands accepted as first argument, anything else updates the seed
+var commandNames = map[string]bool{
+    "plan":    true,
+    "apply":   true,
+    "why":     true,
+    "graph":   true,
+    "lint":    true,
+    "sharing": true,
+}
+
+// reportCommands print a report on standard output, so their progress goes to standard error
+var reportCommands = map[string]bool{
+    "plan":    true,
+    "why":     true,
+    "graph":   true,
+    "lint":    true,
+    "sharing": true,
+}
+
 type SnapInfo struct {
     InstanceName string
     SnapID       string
@@ -45,62 +99,466 @@ type SnapInfo struct {
 func main() {
     // Override the default plug slot sanitizer
     snap.SanitizePlugsSlots = sanitizePlugsSlots
+    initLocale()
+
+    // Parse command-line flags
+    command, args := parseCommandLine()
+    seedDirectory = filepath.Clean(seedDirectory)
 
     // Initialize progress reporting
-    InitProgress()
+    if reportCommands[command] || dryRun {
+        progressOutput = os.Stderr
+    }
+    InitProgress(progressFormat)
+    runSummary.started = time.Now()
     totalSnapSize = 0
 
+    // Only one process may change a seed at a time, and nothing may read it meanwhile. The lock
+    // comes first, so a run that has to give up leaves the listeners of the running one alone.
+    changesSeed := command == "apply" || (!commandNames[command] && !dryRun)
+    lock, err := acquireSeedLock(seedDirectory, !changesSeed, waitForLock, lockTimeout)
+    if err != nil {
+        fatalf("Failed to lock seed: %v", err)
+    }
+    defer lock.Release()
+
+    var progressListeners []EventReporter
+    if progressSocket != "" {
+        socket, err := NewSocketProgressReporter(progressSocket)
+        if err != nil {
+            failf(errKindInternal, "Failed to set up progress socket: %v", err)
+        }
+        progressListeners = append(progressListeners, socket)
+    }
+    if dbusBus != "" {
+        service, err := NewDBusProgressReporter(dbusBus)
+        if err != nil {
+            failf(errKindInternal, "Failed to publish progress on D-Bus: %v", err)
+        }
+        progressListeners = append(progressListeners, service)
+    }
+    StartProgress(progressListeners...)
+
     // Initialize the store client
     storeClient = store.New(nil, nil)
 
-    // Parse command-line flags
-    var seedDirectory string
+    switch command {
+    case "plan":
+        runPlan(args)
+    case "apply":
+        runApply()
+    case "why":
+        runWhy(args)
+    case "graph":
+        runGraph(args)
+    case "lint":
+        runLint()
+    case "sharing":
+        runSharing(args)
+    default:
+        if rollback {
+            if err := rollbackSeed(seedDirectory); err != nil {
+                fatalf("Failed to roll back seed: %v", err)
+            }
+            progressReporter.Report(100, G("Restored the previous seed"))
+            return
+        }
+        runUpdate(args)
+    }
+    emitSummary(resultSuccess, G("Finished"))
+}
+
+// parseCommandLine registers the flags of the command named by the first argument, if any, and parses them.
+// It returns the command and the remaining arguments.
+func parseCommandLine() (string, []string) {
+    command := ""
+    argv := os.Args[1:]
+    if len(argv) > 0 && commandNames[argv[0]] {
+        command = argv[0]
+        argv = argv[1:]
+    }
+
     flag.StringVar(&seedDirectory, "seed", "/var/lib/snapd/seed", "Specify the seed directory")
+    flag.BoolVar(&waitForLock, "wait", false, "Wait for another process working on the same seed instead of failing")
+    flag.DurationVar(&lockTimeout, "wait-timeout", 0, "Give up waiting for the seed lock after this long (0 waits forever)")
     flag.BoolVar(&verbose, "verbose", false, "Enable verbose output")
-    flag.Parse()
+    flag.StringVar(&progressFormat, "progress-format", progressFormatAuto, "Format of the progress output, tab, jsonl or auto for a live display on a terminal and tab otherwise")
+    flag.StringVar(&progressSocket, "progress-socket", "", "Also send progress events as JSON lines to clients of a Unix socket created at this path, or to an existing FIFO")
+    flag.StringVar(&dbusBus, "dbus", "", "Publish progress as "+dbusBusName+" on the D-Bus session or system bus")
+    flag.StringVar(&errorReportPath, "error-report", "", "Write a JSON report of the failure to this file if the run fails")
+    switch command {
+    case "plan":
+        flag.StringVar(&planOutput, "o", "-", "Write the plan to this file, - for standard output")
+        registerResolverFlags()
+        registerIncrementalFlags()
+    case "apply":
+        flag.StringVar(&planInput, "plan", "", "Apply the plan saved in this file")
+        registerDiscardPreviousFlag()
+        registerSummaryFlag()
+        registerOfflineFlag()
+    case "why":
+        registerResolverFlags()
+    case "graph":
+        flag.StringVar(&graphFormat, "format", "dot", "Output format of the graph, dot or json")
+        flag.StringVar(&graphOutput, "o", "-", "Write the graph to this file, - for standard output")
+        registerResolverFlags()
+    case "lint":
+        flag.StringVar(&reportFormat, "format", "text", "Output format of the findings, text or json")
+        registerProviderFlags()
+    case "sharing":
+        flag.StringVar(&reportFormat, "format", "text", "Output format of the report, text or json")
+        registerResolverFlags()
+    default:
+        flag.BoolVar(&rollback, "rollback", false, "Restore the previous seed generation and exit")
+        flag.BoolVar(&dryRun, "dry-run", false, "Print the planned changes to the seed without downloading, deleting or rewriting anything")
+        registerResolverFlags()
+        registerIncrementalFlags()
+        registerSummaryFlag()
+        registerOfflineFlag()
+        registerDiscardPreviousFlag()
+    }
+    flag.CommandLine.Parse(argv)
+
+    // A report left by an earlier run must not be mistaken for one of this run
+    if errorReportPath != "" {
+        if err := os.Remove(errorReportPath); err != nil && !os.IsNotExist(err) {
+            failf(errKindUsage, "Failed to remove old error report: %v", err)
+        }
+    }
+
+    // Removing a snap by name only makes sense when the others are kept
+    if len(removeSnaps) > 0 {
+        incremental = true
+    }
+
+    if progressFormat != progressFormatAuto && progressFormat != progressFormatTab && progressFormat != progressFormatJSONL {
+        failf(errKindUsage, "Unknown progress format %s, use auto, tab or jsonl", progressFormat)
+    }
+    if dbusBus != "" && dbusBus != dbusSessionBus && dbusBus != dbusSystemBus {
+        failf(errKindUsage, "Unknown bus %s, use session or system", dbusBus)
+    }
+    if onOffline != offlineKeep && onOffline != offlineFail {
+        failf(errKindUsage, "Unknown offline policy %s, use keep or fail", onOffline)
+    }
+    if summaryFormat != "" && summaryFormat != summaryFormatText && summaryFormat != summaryFormatJSON {
+        failf(errKindUsage, "Unknown summary format %s, use text or json", summaryFormat)
+    }
+    if command == "apply" && (planInput == "" || flag.NArg() > 0) {
+        failf(errKindUsage, "Usage: %s apply --plan FILE", os.Args[0])
+    }
+    if command == "why" && flag.NArg() == 0 {
+        failf(errKindUsage, "Usage: %s why SNAP [SNAP...]", os.Args[0])
+    }
+    if command == "graph" && graphFormat != "dot" && graphFormat != "json" {
+        failf(errKindUsage, "Usage: %s graph [--format dot|json] [SNAP...]", os.Args[0])
+    }
+    if command == "lint" && ((reportFormat != "text" && reportFormat != "json") || flag.NArg() > 0) {
+        failf(errKindUsage, "Usage: %s lint [--format text|json]", os.Args[0])
+    }
+    if command == "sharing" && reportFormat != "text" && reportFormat != "json" {
+        failf(errKindUsage, "Usage: %s sharing [--format text|json] [SNAP...]", os.Args[0])
+    }
+    return command, flag.Args()
+}
+
+// registerDiscardPreviousFlag registers the flag dropping the previous generation kept for --rollback
+func registerDiscardPreviousFlag() {
+    flag.BoolVar(&discardPrevious, "discard-previous", false, "Do not keep the replaced seed as the previous generation for --rollback")
+}
+
+// registerResolverFlags registers the flags changing which snaps make up the seed
+func registerResolverFlags() {
+    flag.Var(&localSnapPaths, "local-snap", "Seed a locally built snap file as unasserted (can be repeated)")
+    registerProviderFlags()
+    flag.Var(&maxSeedSize, "max-size", "Fail before downloading if the seed would be larger than this, such as 2.5G")
+    flag.Var(snapBudgetFlag{}, "snap-budget", "Fail before downloading if snap NAME would be larger than SIZE, given as NAME=SIZE (can be repeated)")
+    flag.BoolVar(&strictAssumes, "strict-assumes", false, "Fail before downloading if a snap assumes features the seeded snapd lacks or its base is missing")
+}
+
+// registerProviderFlags registers the flags choosing the content providers of the seed
+func registerProviderFlags() {
+    flag.Var(providerOverrideFlag{}, "provider-override", "Use PROVIDER for content TAG of SNAP instead of its default-provider, given as SNAP:TAG=PROVIDER with * matching any snap (can be repeated)")
+    flag.Var(excludeFlag{}, "exclude", "Never pull in this content provider (can be repeated)")
+}
+
+// registerOfflineFlag registers the flag deciding what happens when the store cannot be reached
+func registerOfflineFlag() {
+    flag.StringVar(&onOffline, "on-offline", offlineFail, "When the Snap Store cannot be reached, keep the existing seed and succeed, or fail")
+}
+
+// registerSummaryFlag registers the flag printing what happened to every snap at the end of a run
+func registerSummaryFlag() {
+    flag.StringVar(&summaryFormat, "summary", "", "Print the revisions, download method, bytes and time of every snap at the end, as text or json")
+}
+
+// registerIncrementalFlags registers the flags for keeping the existing seed and removing snaps from it
+func registerIncrementalFlags() {
+    flag.BoolVar(&incremental, "incremental", false, "Keep the snaps already in seed.yaml in addition to the requested ones")
+    flag.Var(&removeSnaps, "remove", "Remove a snap from the seed, implies --incremental (can be repeated)")
+}
+
+// runUpdate brings the seed in line with the requested snaps, or only prints what would change for a dry run
+func runUpdate(snapNames []string) {
+    updatingSeed = !dryRun
+    snapsDir, assertionsDir := openSeed()
+    snapsToProcess, previousSnaps := resolveSeed(snapNames, snapsDir, assertionsDir)
+
+    if dryRun {
+        plan, err := buildSeedPlan(snapsToProcess, previousSnaps, snapsDir, assertionsDir)
+        if err != nil {
+            fatalf("Failed to plan seed changes: %v", err)
+        }
+        printSeedPlan(os.Stdout, plan)
+        return
+    }
+
+    // Make sure everything fits before the seed is staged
+    checkDiskSpace(snapsToProcess, seedDirectory)
+    snapsDir, assertionsDir = stageSeed()
+    applySeedChanges(snapsToProcess, nil, nil, snapsDir, assertionsDir)
+}
+
+// runPlan resolves the requested snaps and saves the resulting plan for a later apply
+func runPlan(snapNames []string) {
+    snapsDir, assertionsDir := openSeed()
+    snapsToProcess, previousSnaps := resolveSeed(snapNames, snapsDir, assertionsDir)
+
+    plan, err := buildSeedPlan(snapsToProcess, previousSnaps, snapsDir, assertionsDir)
+    if err != nil {
+        fatalf("Failed to plan seed changes: %v", err)
+    }
+    if plan.Fingerprint, err = seedFingerprint(seedDirectory); err != nil {
+        fatalf("Failed to fingerprint seed: %v", err)
+    }
+    if err := writeSeedPlan(planOutput, plan); err != nil {
+        fatalf("Failed to save plan: %v", err)
+    }
+    verboseLog("Saved plan to %s", planOutput)
+}
+
+// runApply carries out a plan saved by runPlan, provided the seed has not changed since
+func runApply() {
+    plan, err := readSeedPlan(planInput)
+    if err != nil {
+        fatalf("Failed to load plan: %v", err)
+    }
+    fingerprint, err := seedFingerprint(seedDirectory)
+    if err != nil {
+        fatalf("Failed to fingerprint seed: %v", err)
+    }
+    if fingerprint != plan.Fingerprint {
+        failf(errKindSeed, "The seed in %s has changed since the plan was made, please make a new plan", seedDirectory)
+    }
+
+    updatingSeed = true
+    openSeed()
+    snapsToProcess, err := plan.restore()
+    if err != nil {
+        fatalf("Failed to load plan: %v", err)
+    }
+    weighRemainingSteps(snapsToProcess)
+    progressTracker.Finish(G("Loaded the saved plan"))
+
+    // Make sure everything fits before the seed is staged
+    checkDiskSpace(snapsToProcess, seedDirectory)
+    snapsDir, assertionsDir := stageSeed()
+    applySeedChanges(snapsToProcess, []byte(plan.SeedYaml), plan.Requested, snapsDir, assertionsDir)
+}
+
+// runWhy explains how a snap enters the seed. The snaps after the first are the requested snaps,
+// without them the snaps of the existing seed are used.
+func runWhy(args []string) {
+    snapName := args[0]
+    resolveExistingSeed(args[1:])
+    if !explainSnap(os.Stdout, snapName) {
+        emitSummary(resultFailure, fmt.Sprintf(G("%s is not in the seed"), snapName))
+        os.Exit(1)
+    }
+}
+
+// runGraph prints the dependency graph of the seed resolved from the given snaps,
+// or from the snaps of the existing seed if there are none
+func runGraph(snapNames []string) {
+    resolveExistingSeed(snapNames)
+
+    graph := buildSeedGraph()
+    content := renderGraphDot(graph)
+    if graphFormat == "json" {
+        var err error
+        if content, err = renderGraphJSON(graph); err != nil {
+            fatalf("Failed to write graph: %v", err)
+        }
+    }
+    if err := writeOutput(graphOutput, content); err != nil {
+        fatalf("Failed to write graph: %v", err)
+    }
+}
+
+// runLint checks the seed for problems, exiting with an error if any finding is an error
+func runLint() {
+    report, err := lintSeed(seedDirectory)
+    if err != nil {
+        fatalf("Failed to lint seed: %v", err)
+    }
+    if reportFormat == "json" {
+        if err := writeLintReportJSON(report); err != nil {
+            fatalf("Failed to write lint report: %v", err)
+        }
+    } else {
+        printLintReport(report)
+    }
+    if report.Errors > 0 {
+        emitSummary(resultFailure, G("The seed has lint errors"))
+        os.Exit(1)
+    }
+}
+
+// runSharing reports how the apps of the seed resolved from the given snaps, or of the existing seed
+// if there are none, share bases and content snaps
+func runSharing(snapNames []string) {
+    resolveExistingSeed(snapNames)
+
+    report := buildSharingReport()
+    if reportFormat == "json" {
+        if err := writeSharingReportJSON(report); err != nil {
+            fatalf("Failed to write sharing report: %v", err)
+        }
+        return
+    }
+    printSharingReport(report)
+}
+
+// resolveExistingSeed resolves the given snaps without changing the seed.
+// Without any snaps, the snaps of the existing seed are resolved instead.
+func resolveExistingSeed(snapNames []string) {
+    if len(snapNames) == 0 {
+        incremental = true
+    }
+    snapsDir, assertionsDir := openSeed()
+    resolveSeed(snapNames, snapsDir, assertionsDir)
+}
+
+// openSeed loads the model and the snaps already in the seed, without changing anything.
+// It returns the snaps and assertions directories of the live seed.
+func openSeed() (string, string) {
     if !verbose {
-        fmt.Printf("2\tLoading existing snaps...\n")
+        progressTracker.ReportStatus(G("Loading existing snaps..."))
     }
 
-    // Define directories based on the seed directory
     snapsDir := filepath.Join(seedDirectory, "snaps")
     assertionsDir := filepath.Join(seedDirectory, "assertions")
     seedYaml = filepath.Join(seedDirectory, "seed.yaml")
 
-    // Setup directories and seed.yaml
-    initializeDirectories(snapsDir, assertionsDir)
-    initializeSeedYaml()
+    // Load the model, which decides what kind of snaps may be seeded
+    var err error
+    seedModel, err = loadSeedModel(assertionsDir)
+    if err != nil {
+        fatalf("Failed to load model assertion: %v", err)
+    }
 
     // Load existing snaps from seed.yaml
     existingSnapsInYaml := loadExistingSnaps()
+    progressTracker.SetStep(stepLoading, 1, float64(len(existingSnapsInYaml)))
 
     // Populate currentSnaps based on existing snaps
-    for snapName := range existingSnapsInYaml {
-        snapInfo, err := getCurrentSnapInfo(assertionsDir, snapName)
+    for snapName, entry := range existingSnapsInYaml {
+        var snapInfo *store.CurrentSnap
+        var err error
+        if entry.Unasserted {
+            // Unasserted snaps have no assertion to read the revision from
+            snapInfo = &store.CurrentSnap{InstanceName: snapName, Revision: localRevision}
+        } else {
+            snapInfo, err = getCurrentSnapInfo(assertionsDir, snapName)
+        }
+        progressTracker.Advance(1, "")
         if err != nil {
             verboseLog("Failed to get info for existing snap %s: %v", snapName, err)
             continue
         }
         currentSnaps = append(currentSnaps, snapInfo)
+        recordOldRevision(snapInfo.InstanceName, snapInfo.Revision)
     }
+    progressTracker.Finish(fmt.Sprintf(NG("Loaded %d existing snap", "Loaded %d existing snaps", len(currentSnaps)), len(currentSnaps)))
 
+    return snapsDir, assertionsDir
+}
+
+// stageSeed starts staging the changes in a working copy of the seed, which only reach the live
+// seed once it validates. It returns the snaps and assertions directories to work in.
+func stageSeed() (string, string) {
+    var err error
+    activeTransaction, err = beginSeedTransaction(seedDirectory)
+    if err != nil {
+        fatalf("Failed to prepare seed update: %v", err)
+    }
+
+    // Define directories based on the working directory
+    snapsDir := filepath.Join(activeTransaction.stageDir, "snaps")
+    assertionsDir := filepath.Join(activeTransaction.stageDir, "assertions")
+    seedYaml = filepath.Join(activeTransaction.stageDir, "seed.yaml")
+
+    // Setup directories and seed.yaml
+    initializeDirectories(snapsDir, assertionsDir)
+    initializeSeedYaml()
+    return snapsDir, assertionsDir
+}
+
+// resolveSeed resolves the requested snaps and their dependencies against the store.
+// It returns the snaps that need to be downloaded and the snaps the seed had beforehand.
+func resolveSeed(snapNames []string, snapsDir, assertionsDir string) ([]SnapDetails, []*store.CurrentSnap) {
     // Process essential snaps
     requiredSnaps = map[string]bool{"snapd": true, "bare": true}
-    for _, arg := range flag.Args() {
+    requestedNames := make(map[string]bool)
+    for _, arg := range snapNames {
         requiredSnaps[arg] = true
+        requestedNames[strings.SplitN(arg, "=", 2)[0]] = true
+    }
+    removeSet := make(map[string]bool)
+    for _, name := range removeSnaps {
+        removeSet[name] = true
+    }
+    if incremental {
+        roots, err := incrementalRoots(snapsDir, removeSet)
+        if err != nil {
+            failf(errKindSeed, "Failed to read existing seed: %v", err)
+        }
+        // Snaps named on the command line take their channel from there
+        for _, root := range roots {
+            if !requestedNames[strings.SplitN(root, "=", 2)[0]] {
+                requiredSnaps[root] = true
+            }
+        }
+    }
+    for entry := range requiredSnaps {
+        requestedSnaps[strings.SplitN(entry, "=", 2)[0]] = true
     }
     if !verbose {
-        fmt.Printf("4\tFetching information from the Snap Store...\n")
+        progressTracker.ReportStatus(G("Fetching information from the Snap Store..."))
     }
 
-    // Collect snaps to process
+    // Collect snaps to process, every required snap takes at least one store lookup
+    progressTracker.SetStep(stepResolving, float64(len(requiredSnaps))*requestCost, float64(len(requiredSnaps)))
+    resolveStarted := time.Now()
+    previousSnaps := append([]*store.CurrentSnap(nil), currentSnaps...)
     snapsToProcess, err := collectSnapsToProcess(snapsDir, assertionsDir)
     if err != nil {
-        log.Fatalf("Failed to collect snaps to process: %v", err)
+        fatalf("Failed to collect snaps to process: %v", err)
     }
+    measureRequestCost(time.Since(resolveStarted))
+    weighRemainingSteps(snapsToProcess)
+    explainRemovals(removeSet)
+    warnUnsatisfiedContent()
+    reportAssumesProblems(strictAssumes)
+    enforceSizeBudgets(snapsToProcess, snapsDir)
+
+    progressTracker.Finish(G("Finished collecting snap info"))
+    return snapsToProcess, previousSnaps
+}
 
-    progressTracker.Finish("Finished collecting snap info")
-
+// applySeedChanges downloads the given snaps into the working copy, writes seed.yaml and swaps the
+// validated seed in. seed.yaml and the requested snaps come from currentSnaps unless seedContent
+// and requested are given.
+func applySeedChanges(snapsToProcess []SnapDetails, seedContent []byte, requested []string, snapsDir, assertionsDir string) {
     // Calculate the number of snaps to download
     totalSnaps := len(snapsToProcess)
     if totalSnaps == 0 {
@@ -109,25 +567,19 @@ func main() {
         verboseLog("Total snaps to download: %d", totalSnaps)
     }
 
-    // Initialize variables to track download progress
-    completedSnaps := 0
-
-    // Update "Downloading snaps" step to 0%
-    progressTracker.UpdateStepProgress(0)
+    runSummary.applying = true
 
-    // Process all the snaps that need updates
+    // Process all the snaps that need updates, the download step advances with every byte and assertion
     for _, snapDetails := range snapsToProcess {
         if err := processSnap(snapDetails, snapsDir, assertionsDir); err != nil {
-            log.Fatalf("Failed to process snap %s: %v", snapDetails.InstanceName, err)
+            fatalf("Failed to process snap %s: %v", snapDetails.InstanceName, err)
         }
-        completedSnaps++
-
-        progressTracker.UpdateStepProgress(-1)
+        runSummary.downloaded++
     }
 
     // Mark "Downloading snaps" as complete
     if totalSnaps > 0 {
-        progressTracker.Finish("Downloading snaps completed")
+        progressTracker.Finish(G("Downloading snaps completed"))
     } else {
         // If no snaps to download, skip to finalizing
         progressTracker.NextStep()
@@ -137,22 +589,38 @@ func main() {
     cleanUpCurrentSnaps(assertionsDir, snapsDir)
 
     // Update seed.yaml with the current required snaps
-    if err := updateSeedYaml(snapsDir, currentSnaps); err != nil {
-        log.Fatalf("Failed to update seed.yaml: %v", err)
+    var err error
+    if seedContent != nil {
+        err = writeSeedYaml(seedContent)
+    } else {
+        err = updateSeedYaml(snapsDir, currentSnaps)
+        requested = requestedSeedSnaps(currentSnaps)
+    }
+    if err == nil {
+        err = writeRequestedSnaps(requested)
+    }
+    if err != nil {
+        failf(errKindSeed, "Failed to update seed.yaml: %v", err)
     }
 
-    // Perform cleanup and validation tasks
-    removeStateJson(filepath.Join(seedDirectory, "..", "state.json"))
+    // Perform cleanup and validate the staged seed before it replaces the live one
     ensureAssertions(assertionsDir)
+    cleanUpFiles(snapsDir, assertionsDir)
     if err := validateSeed(seedYaml); err != nil {
-        log.Fatalf("Seed validation failed: %v", err)
+        failf(errKindValidation, "Seed validation failed: %v", err)
     }
-    cleanUpFiles(snapsDir, assertionsDir)
+    progressTracker.Advance(validateSeedCost, G("Validated the seed"))
+    if err := activeTransaction.Commit(!discardPrevious); err != nil {
+        fatalf("Failed to replace seed: %v", err)
+    }
+    activeTransaction = nil
+    removeStateJson(filepath.Join(seedDirectory, "..", "state.json"))
 
     // Mark "Finalizing" as complete
     if progressTracker != nil {
-        progressTracker.Finish("Cleanup and validation completed")
+        progressTracker.Finish(G("Cleanup and validation completed"))
     }
+    reportSnapStats()
 }
 
 // collectSnapsToProcess collects all snaps and their dependencies, returning only those that need updates
@@ -170,6 +638,13 @@ func collectSnapsToProcess(snapsDir, assertionsDir string) ([]SnapDetails, error
     }
 
     fallbackChannel := "latest/stable"
+
+    // Local snaps go first, so they take precedence over store snaps of the same name
+    localDetails, err := collectLocalSnaps(localSnapPaths, defaultChannel, fallbackChannel, snapsDir, assertionsDir)
+    if err != nil {
+        return nil, err
+    }
+
     for snapEntry := range requiredSnaps {
         // Extract channel if specified, default to "stable"
         parts := strings.SplitN(snapEntry, "=", 2)
@@ -186,8 +661,19 @@ func collectSnapsToProcess(snapsDir, assertionsDir string) ([]SnapDetails, error
         }
 
         // Append only those snaps that need updates
-        for _, snapDetails := range snapList {
-            verboseLog("Processing snap: %s", snapDetails.InstanceName)
+        snapsToProcess = appendSnapsToProcess(snapsToProcess, snapList)
+    }
+    snapsToProcess = appendSnapsToProcess(snapsToProcess, localDetails)
+
+    return snapsToProcess, nil
+}
+
+// appendSnapsToProcess appends snaps needing updates to snapsToProcess, accounting for their download size
+func appendSnapsToProcess(snapsToProcess []SnapDetails, snapList []SnapDetails) []SnapDetails {
+    for _, snapDetails := range snapList {
+        verboseLog("Processing snap: %s", snapDetails.InstanceName)
+        // Local snaps are copied, not downloaded
+        if snapDetails.LocalPath == "" {
             if len(snapDetails.Result.Deltas) > 0 {
                 for _, delta := range snapDetails.Result.Deltas {
                     verboseLog("Delta found for %s from %d to %d", snapDetails.InstanceName, delta.FromRevision, delta.ToRevision)
@@ -200,16 +686,56 @@ func collectSnapsToProcess(snapsDir, assertionsDir string) ([]SnapDetails, error
                 snapSizeMap[snapDetails.Result.Info.SuggestedName] = snapSize
                 totalSnapSize += snapSize
             }
-            snapsToProcess = append(snapsToProcess, snapDetails)
         }
+        snapsToProcess = append(snapsToProcess, snapDetails)
     }
-
-    return snapsToProcess, nil
+    return snapsToProcess
 }
 
 // sanitizePlugsSlots is a placeholder function to sanitize plug slots in snap.Info
 func sanitizePlugsSlots(info *snap.Info) {}
 
+// fatalf throws away any staged seed changes and exits with an error. The format is translated,
+// the kind of failure comes from the first error among the arguments.
+func fatalf(format string, v ...interface{}) {
+    failf(classifyError(firstError(v)), format, v...)
+}
+
+// failf throws away any staged seed changes and exits with the exit code of a kind of failure,
+// writing the error report if one was asked for. The format is translated. A store that cannot
+// be reached ends the run with the existing seed instead if --on-offline keep is given.
+func failf(kind errorKind, format string, v ...interface{}) {
+    if activeTransaction != nil {
+        activeTransaction.Abort()
+        activeTransaction = nil
+    }
+    // A full disk is the real cause, whatever the caller was doing
+    err := firstError(v)
+    if errors.Is(err, syscall.ENOSPC) {
+        kind = errKindDiskFull
+    }
+    if kind == errKindNetwork && onOffline == offlineKeep && updatingSeed {
+        keepExistingSeed(err)
+    }
+    message := fmt.Sprintf(G(format), v...)
+    writeErrorReport(kind, message, err)
+    if progressReporter != nil {
+        emitEvent(progressEvent{Type: eventError, Message: message, ErrorID: kind.ID})
+        emitSummary(resultFailure, message)
+    }
+    log.Print(message)
+    os.Exit(kind.ExitCode)
+}
+
+// warnf logs a warning, which is shown even without --verbose. The format is translated.
+func warnf(format string, v ...interface{}) {
+    message := fmt.Sprintf(G(format), v...)
+    log.Printf(G("Warning: %s"), message)
+    if progressReporter != nil {
+        emitEvent(progressEvent{Type: eventWarning, Message: message})
+    }
+}
+
 // verboseLog logs messages only when verbose mode is enabled
 func verboseLog(format string, v ...interface{}) {
     if verbose {
@@ -0,0 +1,52 @@
+// Copyright (C) 2024 Simon Quigley <tsimonq2@ubuntu.com>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 3
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+package main
+
+import (
+    "os"
+    "path/filepath"
+)
+
+// Policies for a store that cannot be reached
+const (
+    offlineKeep = "keep"
+    offlineFail = "fail"
+)
+
+// onOffline is the policy for a store that cannot be reached, set with --on-offline
+var onOffline = offlineFail
+
+// updatingSeed is set while apply or an update other than a dry run works on the seed. Only
+// these runs have an existing seed to fall back to, everything else fails as it is.
+var updatingSeed bool
+
+// keepExistingSeed ends a run that lost the store with the seed as it was before the run.
+// The staged changes are already thrown away. The live seed is validated, then the run
+// succeeds without touching it. Without an existing seed, the run fails as unreachable.
+func keepExistingSeed(reason error) {
+    // Failing from here on is final
+    onOffline = offlineFail
+
+    if !fileExists(filepath.Join(seedDirectory, "seed.yaml")) {
+        failf(errKindNetwork, "The Snap Store cannot be reached and there is no existing seed to keep: %v", reason)
+    }
+    warnf("The Snap Store cannot be reached, keeping the existing seed: %v", reason)
+    if err := validateSeed(filepath.Join(seedDirectory, "seed.yaml")); err != nil {
+        failf(errKindValidation, "The Snap Store cannot be reached and the existing seed is not valid: %v", err)
+    }
+    if progressReporter != nil {
+        progressReporter.Report(100, G("Kept existing seed"))
+        emitSummary(resultSuccess, G("Kept existing seed"))
+    }
+    os.Exit(0)
+}
@@ -0,0 +1,390 @@
+// Copyright (C) 2024 Simon Quigley <tsimonq2@ubuntu.com>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 3
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+package main
+
+import (
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io"
+    "io/fs"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+
+    "github.com/snapcore/snapd/snap"
+    "github.com/snapcore/snapd/store"
+    "github.com/snapcore/snapd/strutil"
+    "golang.org/x/crypto/sha3"
+)
+
+// Ways a planned snap ends up in the seed
+const (
+    methodDelta = "delta"
+    methodFull  = "full"
+    methodLocal = "local"
+    methodKept  = "kept"
+)
+
+// seedPlanFormat is the version of the saved plan format
+const seedPlanFormat = 1
+
+// plannedSnap describes what happens to a single snap of the seed
+type plannedSnap struct {
+    Name        string        `json:"name"`
+    SnapID      string        `json:"snap-id,omitempty"`
+    Channel     string        `json:"channel,omitempty"`
+    Version     string        `json:"version,omitempty"`
+    OldRevision snap.Revision `json:"old-revision"`
+    NewRevision snap.Revision `json:"new-revision"`
+    Method      string        `json:"method,omitempty"`
+    // Size is the number of bytes to download, or to copy for local snaps
+    Size        int64         `json:"size,omitempty"`
+
+    // Everything needed to fetch the snap and its assertions without asking the store again
+    PublisherID string           `json:"publisher-id,omitempty"`
+    DownloadURL string           `json:"download-url,omitempty"`
+    SnapSize    int64            `json:"snap-size,omitempty"`
+    Sha3_384    string           `json:"sha3-384,omitempty"`
+    Deltas      []snap.DeltaInfo `json:"deltas,omitempty"`
+    LocalPath   string           `json:"local-path,omitempty"`
+    // Reason explains why a snap is removed
+    Reason      string           `json:"reason,omitempty"`
+}
+
+// seedPlan lists every change a run would make to the seed
+type seedPlan struct {
+    Format      int           `json:"format"`
+    // Fingerprint identifies the state of the seed the plan was made for
+    Fingerprint string        `json:"seed-fingerprint,omitempty"`
+    Add         []plannedSnap `json:"add"`
+    Upgrade     []plannedSnap `json:"upgrade"`
+    Keep        []plannedSnap `json:"keep"`
+    Remove      []plannedSnap `json:"remove"`
+    // DeleteFiles are relative to the seed directory
+    DeleteFiles []string      `json:"delete-files"`
+    SeedYaml    string        `json:"seed-yaml"`
+    Requested   []string      `json:"requested"`
+}
+
+// buildSeedPlan works out the changes to the seed from the resolved snaps, without touching anything on disk.
+// previousSnaps are the snaps of the seed before resolution started.
+func buildSeedPlan(snapsToProcess []SnapDetails, previousSnaps []*store.CurrentSnap, snapsDir, assertionsDir string) (*seedPlan, error) {
+    plan := &seedPlan{Format: seedPlanFormat}
+
+    previousRevisions := make(map[string]snap.Revision)
+    for _, previous := range previousSnaps {
+        previousRevisions[previous.InstanceName] = previous.Revision
+    }
+    updates := make(map[string]SnapDetails)
+    for _, snapDetails := range snapsToProcess {
+        updates[snapDetails.InstanceName] = snapDetails
+    }
+
+    keptSnaps, droppedSnaps := splitRequiredSnaps()
+    for _, current := range keptSnaps {
+        planned := plannedSnap{
+            Name:        current.InstanceName,
+            Channel:     strings.Replace(current.TrackingChannel, "latest/", "", -1),
+            OldRevision: previousRevisions[current.InstanceName],
+            NewRevision: current.Revision,
+            Method:      methodKept,
+        }
+        snapDetails, needsUpdate := updates[current.InstanceName]
+        switch {
+        case needsUpdate && snapDetails.LocalPath != "":
+            planned.Method = methodLocal
+            planned.LocalPath = snapDetails.LocalPath
+            fi, err := os.Stat(snapDetails.LocalPath)
+            if err != nil {
+                return nil, err
+            }
+            planned.Size = fi.Size()
+            checksum, err := fileSha3_384(snapDetails.LocalPath)
+            if err != nil {
+                return nil, err
+            }
+            planned.Sha3_384 = checksum
+        case needsUpdate && len(snapDetails.Result.Deltas) > 0:
+            planned.Method = methodDelta
+            planned.Size = int64(snapSizeMap[current.InstanceName])
+        case needsUpdate:
+            planned.Method = methodFull
+            planned.Size = snapDetails.Result.Info.Size
+        }
+        if needsUpdate && snapDetails.Result != nil {
+            info := snapDetails.Result.Info
+            planned.SnapID = info.SnapID
+            planned.Version = info.Version
+            planned.PublisherID = info.Publisher.ID
+            planned.DownloadURL = info.DownloadURL
+            planned.SnapSize = info.Size
+            planned.Sha3_384 = info.Sha3_384
+            planned.Deltas = info.Deltas
+        }
+
+        _, existed := previousRevisions[current.InstanceName]
+        switch {
+        case planned.Method == methodKept:
+            plan.Keep = append(plan.Keep, planned)
+        case existed:
+            plan.Upgrade = append(plan.Upgrade, planned)
+        default:
+            plan.Add = append(plan.Add, planned)
+        }
+    }
+    for _, current := range droppedSnaps {
+        plan.Remove = append(plan.Remove, plannedSnap{
+            Name:        current.InstanceName,
+            Channel:     strings.Replace(current.TrackingChannel, "latest/", "", -1),
+            OldRevision: current.Revision,
+            Reason:      removalReasons[current.InstanceName],
+        })
+    }
+
+    seedContent, err := renderSeedYaml(keptSnaps)
+    if err != nil {
+        return nil, err
+    }
+    plan.SeedYaml = string(seedContent)
+    plan.Requested = requestedSeedSnaps(keptSnaps)
+
+    // Whatever the new seed.yaml no longer references is deleted at the end of a run
+    seedDoc, err := parseSeedDocument(seedContent)
+    if err != nil {
+        return nil, err
+    }
+    entries, err := seedDoc.entries()
+    if err != nil {
+        return nil, err
+    }
+    seedDir := filepath.Dir(snapsDir)
+    for _, filePath := range staleSeedFiles(snapsDir, assertionsDir, seed{Snaps: entries}) {
+        relPath, err := filepath.Rel(seedDir, filePath)
+        if err != nil {
+            return nil, err
+        }
+        plan.DeleteFiles = append(plan.DeleteFiles, relPath)
+    }
+
+    for _, list := range [][]plannedSnap{plan.Add, plan.Upgrade, plan.Keep, plan.Remove} {
+        sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+    }
+    return plan, nil
+}
+
+// printSeedPlan writes a human-readable form of the plan
+func printSeedPlan(w io.Writer, plan *seedPlan) {
+    fmt.Fprintf(w, "Snaps to add:\n")
+    printPlannedSnaps(w, plan.Add, func(p plannedSnap) string {
+        return fmt.Sprintf("+ %s %s (%s), %s", p.Name, p.NewRevision, describeChannel(p), describeTransfer(p))
+    })
+
+    fmt.Fprintf(w, "Snaps to upgrade:\n")
+    printPlannedSnaps(w, plan.Upgrade, func(p plannedSnap) string {
+        return fmt.Sprintf("~ %s %s -> %s (%s), %s", p.Name, p.OldRevision, p.NewRevision, describeChannel(p), describeTransfer(p))
+    })
+
+    fmt.Fprintf(w, "Snaps to keep:\n")
+    printPlannedSnaps(w, plan.Keep, func(p plannedSnap) string {
+        return fmt.Sprintf("= %s %s (%s)", p.Name, p.NewRevision, describeChannel(p))
+    })
+
+    fmt.Fprintf(w, "Snaps to remove:\n")
+    printPlannedSnaps(w, plan.Remove, func(p plannedSnap) string {
+        if p.Reason != "" {
+            return fmt.Sprintf("- %s %s (%s)", p.Name, p.OldRevision, p.Reason)
+        }
+        return fmt.Sprintf("- %s %s", p.Name, p.OldRevision)
+    })
+
+    fmt.Fprintf(w, "Files to delete:\n")
+    if len(plan.DeleteFiles) == 0 {
+        fmt.Fprintf(w, "  (none)\n")
+    }
+    for _, filePath := range plan.DeleteFiles {
+        fmt.Fprintf(w, "  %s\n", filePath)
+    }
+
+    fmt.Fprintf(w, "Resulting seed.yaml:\n")
+    for _, line := range strings.Split(strings.TrimRight(plan.SeedYaml, "\n"), "\n") {
+        fmt.Fprintf(w, "  %s\n", line)
+    }
+}
+
+// printPlannedSnaps prints one line per planned snap, or a placeholder for an empty list
+func printPlannedSnaps(w io.Writer, list []plannedSnap, format func(plannedSnap) string) {
+    if len(list) == 0 {
+        fmt.Fprintf(w, "  (none)\n")
+    }
+    for _, planned := range list {
+        fmt.Fprintf(w, "  %s\n", format(planned))
+    }
+}
+
+// describeChannel returns the channel of a planned snap, local snaps having none
+func describeChannel(p plannedSnap) string {
+    if p.Channel == "" {
+        return "unasserted"
+    }
+    return p.Channel
+}
+
+// describeTransfer says how a planned snap gets into the seed and how much data that takes
+func describeTransfer(p plannedSnap) string {
+    switch p.Method {
+    case methodDelta:
+        return fmt.Sprintf("delta download of %s", strutil.SizeToStr(p.Size))
+    case methodLocal:
+        return fmt.Sprintf("local copy of %s", strutil.SizeToStr(p.Size))
+    default:
+        return fmt.Sprintf("full download of %s", strutil.SizeToStr(p.Size))
+    }
+}
+
+// writeSeedPlan saves the plan as JSON, path - meaning standard output
+func writeSeedPlan(path string, plan *seedPlan) error {
+    content, err := json.MarshalIndent(plan, "", "  ")
+    if err != nil {
+        return fmt.Errorf("failed to encode plan: %w", err)
+    }
+    return writeOutput(path, append(content, '\n'))
+}
+
+// readSeedPlan loads a plan saved by writeSeedPlan
+func readSeedPlan(path string) (*seedPlan, error) {
+    content, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    var plan seedPlan
+    if err := json.Unmarshal(content, &plan); err != nil {
+        return nil, fmt.Errorf("failed to parse plan %s: %w", path, err)
+    }
+    if plan.Format != seedPlanFormat {
+        return nil, fmt.Errorf("plan %s has format %d, expected %d", path, plan.Format, seedPlanFormat)
+    }
+    return &plan, nil
+}
+
+// restore brings back the resolution state recorded in the plan, so the seed can be updated
+// exactly as planned. It returns the snaps to download or copy.
+func (plan *seedPlan) restore() ([]SnapDetails, error) {
+    currentSnaps = nil
+    requiredSnaps = make(map[string]bool)
+    var snapList []SnapDetails
+
+    for _, list := range [][]plannedSnap{plan.Add, plan.Upgrade, plan.Keep} {
+        for _, planned := range list {
+            current := &store.CurrentSnap{
+                InstanceName:    planned.Name,
+                SnapID:          planned.SnapID,
+                Revision:        planned.NewRevision,
+                TrackingChannel: planned.Channel,
+            }
+            currentSnaps = append(currentSnaps, current)
+            requiredSnaps[planned.Name] = true
+
+            switch planned.Method {
+            case methodKept:
+                continue
+            case methodLocal:
+                // The file may have been rebuilt since the plan was made
+                if !verifySnapIntegrity(planned.LocalPath, planned.Sha3_384) {
+                    return nil, fmt.Errorf("local snap %s does not match the plan", planned.LocalPath)
+                }
+                localSnaps[planned.Name] = true
+                snapList = append(snapList, SnapDetails{
+                    InstanceName: planned.Name,
+                    CurrentSnap:  current,
+                    LocalPath:    planned.LocalPath,
+                })
+                continue
+            }
+
+            info := &snap.Info{
+                SuggestedName: planned.Name,
+                Version:       planned.Version,
+                SideInfo: snap.SideInfo{
+                    RealName: planned.Name,
+                    SnapID:   planned.SnapID,
+                    Revision: planned.NewRevision,
+                    Channel:  planned.Channel,
+                },
+                DownloadInfo: snap.DownloadInfo{
+                    DownloadURL: planned.DownloadURL,
+                    Size:        planned.SnapSize,
+                    Sha3_384:    planned.Sha3_384,
+                    Deltas:      planned.Deltas,
+                },
+                Publisher: snap.StoreAccount{ID: planned.PublisherID},
+            }
+            snapList = append(snapList, SnapDetails{
+                InstanceName: planned.Name,
+                Channel:      planned.Channel,
+                CurrentSnap:  current,
+                Result:       &store.SnapActionResult{Info: info},
+            })
+        }
+    }
+
+    // Removed snaps stay in currentSnaps unmarked, so their files get removed
+    for _, planned := range plan.Remove {
+        currentSnaps = append(currentSnaps, &store.CurrentSnap{
+            InstanceName: planned.Name,
+            Revision:     planned.OldRevision,
+        })
+        removalReasons[planned.Name] = planned.Reason
+    }
+
+    return appendSnapsToProcess(nil, snapList), nil
+}
+
+// seedFingerprint identifies the state of a seed directory. It covers seed.yaml and the assertions
+// in full but only the names and sizes of snap files, so the gigabytes of snaps are not read.
+func seedFingerprint(seedDir string) (string, error) {
+    hash := sha3.New256()
+    err := filepath.WalkDir(seedDir, func(path string, entry fs.DirEntry, err error) error {
+        if os.IsNotExist(err) && path == seedDir {
+            // A seed that does not exist yet has an empty fingerprint
+            return filepath.SkipDir
+        }
+        if err != nil || entry.IsDir() {
+            return err
+        }
+        relPath, err := filepath.Rel(seedDir, path)
+        if err != nil {
+            return err
+        }
+        info, err := entry.Info()
+        if err != nil {
+            return err
+        }
+        fmt.Fprintf(hash, "%s\x00%d\x00", relPath, info.Size())
+        if strings.HasSuffix(path, ".snap") {
+            return nil
+        }
+        content, err := ioutil.ReadFile(path)
+        if err != nil {
+            return err
+        }
+        hash.Write(content)
+        return nil
+    })
+    if err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,183 @@
+// Copyright (C) 2024 Simon Quigley <tsimonq2@ubuntu.com>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 3
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+//go:build ignore
+
+// xgettext extracts the translatable messages of the given Go files into a message catalog template.
+// Messages are the string literals passed to G, N_, NG, fatalf, failf and warnf.
+package main
+
+import (
+    "flag"
+    "fmt"
+    "go/ast"
+    "go/parser"
+    "go/token"
+    "io"
+    "log"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// keywords maps the translating functions to the arguments holding the message and,
+// for plural messages, the plural form
+var keywords = map[string][]int{
+    "G":      {0},
+    "N_":     {0},
+    "NG":     {0, 1},
+    "fatalf": {0},
+    "failf":  {1},
+    "warnf":  {0},
+}
+
+// letters are what a message needs at least one of to be worth translating
+const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// message is a single entry of the template
+type message struct {
+    id         string
+    plural     string
+    references []string
+}
+
+var (
+    output  = flag.String("o", "snapd-seed-glue.pot", "Write the template to this file")
+    pkgName = flag.String("package-name", "snapd-seed-glue", "Package name in the header")
+)
+
+func main() {
+    flag.Parse()
+
+    var messages []*message
+    byID := make(map[string]*message)
+    files := flag.Args()
+    sort.Strings(files)
+    fset := token.NewFileSet()
+    for _, path := range files {
+        if strings.HasSuffix(path, "_test.go") {
+            continue
+        }
+        file, err := parser.ParseFile(fset, path, nil, 0)
+        if err != nil {
+            log.Fatalf("Failed to parse %s: %v", path, err)
+        }
+        ast.Inspect(file, func(node ast.Node) bool {
+            call, ok := node.(*ast.CallExpr)
+            if !ok {
+                return true
+            }
+            ident, ok := call.Fun.(*ast.Ident)
+            if !ok {
+                return true
+            }
+            args, ok := keywords[ident.Name]
+            if !ok || len(call.Args) <= args[len(args)-1] {
+                return true
+            }
+            // Formats such as "%v" leave nothing to translate
+            id, ok := stringLiteral(call.Args[args[0]])
+            if !ok || !strings.ContainsAny(strings.ReplaceAll(id, "%v", ""), letters) {
+                return true
+            }
+            plural := ""
+            if len(args) > 1 {
+                plural, _ = stringLiteral(call.Args[args[1]])
+            }
+
+            position := fset.Position(call.Pos())
+            reference := fmt.Sprintf("%s:%d", filepath.Base(position.Filename), position.Line)
+            msg, seen := byID[id]
+            if !seen {
+                msg = &message{id: id, plural: plural}
+                byID[id] = msg
+                messages = append(messages, msg)
+            }
+            msg.references = append(msg.references, reference)
+            return true
+        })
+    }
+
+    out, err := os.Create(*output)
+    if err != nil {
+        log.Fatalf("Failed to create %s: %v", *output, err)
+    }
+    writeTemplate(out, messages)
+    if err := out.Close(); err != nil {
+        log.Fatalf("Failed to write %s: %v", *output, err)
+    }
+}
+
+// stringLiteral returns the value of a string literal, or of literals joined with +
+func stringLiteral(expr ast.Expr) (string, bool) {
+    switch e := expr.(type) {
+    case *ast.BasicLit:
+        if e.Kind != token.STRING {
+            return "", false
+        }
+        value, err := strconv.Unquote(e.Value)
+        return value, err == nil
+    case *ast.BinaryExpr:
+        if e.Op != token.ADD {
+            return "", false
+        }
+        left, ok := stringLiteral(e.X)
+        if !ok {
+            return "", false
+        }
+        right, ok := stringLiteral(e.Y)
+        return left + right, ok
+    }
+    return "", false
+}
+
+// writeTemplate writes the header and the messages in the order they were found
+func writeTemplate(w io.Writer, messages []*message) {
+    fmt.Fprintf(w, `# SOME DESCRIPTIVE TITLE.
+# Copyright (C) YEAR THE PACKAGE'S COPYRIGHT HOLDER
+# This file is distributed under the same license as the %s package.
+# FIRST AUTHOR <EMAIL@ADDRESS>, YEAR.
+#
+#, fuzzy
+msgid ""
+msgstr ""
+"Project-Id-Version: %s\n"
+"Report-Msgid-Bugs-To: \n"
+"PO-Revision-Date: YEAR-MO-DA HO:MI+ZONE\n"
+"Last-Translator: FULL NAME <EMAIL@ADDRESS>\n"
+"Language-Team: LANGUAGE <LL@li.org>\n"
+"Language: \n"
+"MIME-Version: 1.0\n"
+"Content-Type: text/plain; charset=UTF-8\n"
+"Content-Transfer-Encoding: 8bit\n"
+"Plural-Forms: nplurals=INTEGER; plural=EXPRESSION;\n"
+`, *pkgName, *pkgName)
+
+    for _, msg := range messages {
+        fmt.Fprintf(w, "\n#: %s\n", strings.Join(msg.references, " "))
+        fmt.Fprintf(w, "msgid %s\n", poQuote(msg.id))
+        if msg.plural != "" {
+            fmt.Fprintf(w, "msgid_plural %s\n", poQuote(msg.plural))
+            fmt.Fprintf(w, "msgstr[0] \"\"\nmsgstr[1] \"\"\n")
+        } else {
+            fmt.Fprintf(w, "msgstr \"\"\n")
+        }
+    }
+}
+
+// poQuote quotes a string the way PO files do
+func poQuote(s string) string {
+    replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\t", `\t`)
+    return `"` + replacer.Replace(s) + `"`
+}
@@ -19,6 +19,7 @@ import (
     "path/filepath"
     "strconv"
     "strings"
+    "time"
 
     "github.com/snapcore/snapd/snap"
     "github.com/snapcore/snapd/store"
@@ -30,6 +31,8 @@ type SnapDetails struct {
     Channel      string
     CurrentSnap  *store.CurrentSnap
     Result       *store.SnapActionResult
+    // LocalPath is set for unasserted snaps that are copied in rather than downloaded
+    LocalPath    string
 }
 
 // collectSnapDependencies collects all dependencies for a given snap, marking them as requiredSnaps regardless of whether they need updates.
@@ -38,6 +41,7 @@ func collectSnapDependencies(snapName, channel, fallbackChannel, snapsDir, asser
 
     if processedSnaps[snapName] {
         verboseLog("Snap %s has already been processed. Skipping.", snapName)
+        progressTracker.Advance(1, "")
         return snapDetailsList, nil // Added 0 for int64
     }
 
@@ -104,6 +108,7 @@ func collectSnapDependencies(snapName, channel, fallbackChannel, snapsDir, asser
     }
 
     info := result.Info
+    progressTracker.Advance(1, fmt.Sprintf(G("Fetched information about snap %s"), snapName))
 
     // If the snap we fetched has a lower revision than the snap installed, use that
     newRevision := 0
@@ -125,7 +130,21 @@ func collectSnapDependencies(snapName, channel, fallbackChannel, snapsDir, asser
     currentSnaps = append(currentSnaps, newSnap)
     processedSnaps[snapName] = true
 
+    // Mark the snap as required whether or not it needs an update
+    requiredSnaps[snapName] = true
+
     needsUpdate := (oldSnapPath == "" || oldSnap.Revision.N < info.Revision.N)
+    resolveMessage := "up to date"
+    if needsUpdate {
+        resolveMessage = "needs download"
+    }
+    emitEvent(progressEvent{
+        Type:     eventResolve,
+        Snap:     snapName,
+        Revision: newSnap.Revision.String(),
+        Channel:  workingChannel,
+        Message:  resolveMessage,
+    })
 
     if needsUpdate {
         snapDetailsList = append(snapDetailsList, SnapDetails{
@@ -134,34 +153,50 @@ func collectSnapDependencies(snapName, channel, fallbackChannel, snapsDir, asser
             CurrentSnap:  newSnap,
             Result:       result,
         })
-    } else {
-        // Mark the snap as required even if no update is needed
-        requiredSnaps[snapName] = true
     }
 
+    prereqDetails, err := collectSnapPrereqs(snapName, info, channel, fallbackChannel, snapsDir, assertionsDir)
+    if err != nil {
+        return nil, err
+    }
+    snapDetailsList = append(snapDetailsList, prereqDetails...)
+
+    return snapDetailsList, nil
+}
+
+// collectSnapPrereqs collects the content default-providers and the base of a snap, along with their own dependencies.
+func collectSnapPrereqs(snapName string, info *snap.Info, channel, fallbackChannel, snapsDir, assertionsDir string) ([]SnapDetails, error) {
+    var snapDetailsList []SnapDetails
+
     // Safely handle dependencies
     tracker := snap.SimplePrereqTracker{}
-    missingPrereqs := tracker.MissingProviderContentTags(info, nil)
-    for prereq := range missingPrereqs {
+    missingPrereqs := resolveContentProviders(snapName, tracker.MissingProviderContentTags(info, nil))
+    for prereq, tags := range missingPrereqs {
+        recordDependency(snapName, prereq, dependencyContent, tags)
         if !processedSnaps[prereq] {
             verboseLog("Collecting dependencies for prerequisite snap: %s for %s", prereq, snapName)
+            progressTracker.AddWork(1, requestCost)
             prereqDetails, err := collectSnapDependencies(prereq, channel, fallbackChannel, snapsDir, assertionsDir)
             if err != nil {
                 // Additional logging for dependency resolution issues
                 verboseLog("Failed to collect dependencies for prerequisite %s for snap %s: %v", prereq, snapName, err)
-                return nil, fmt.Errorf("failed to collect dependencies for prerequisite %s for snap %s: %v", prereq, snapName, err) // Added 0 for int64
+                return nil, fmt.Errorf("failed to collect dependencies for prerequisite %s for snap %s: %w", prereq, snapName, err) // Added 0 for int64
             }
             snapDetailsList = append(snapDetailsList, prereqDetails...)
         }
     }
 
     // Also handle base snaps safely
+    if info.Base != "" {
+        recordDependency(snapName, info.Base, dependencyBase, nil)
+    }
     if info.Base != "" && !processedSnaps[info.Base] {
         verboseLog("Collecting dependencies for base snap: %s for %s", info.Base, snapName)
+        progressTracker.AddWork(1, requestCost)
         baseDetails, err := collectSnapDependencies(info.Base, channel, fallbackChannel, snapsDir, assertionsDir)
         if err != nil {
             verboseLog("Failed to collect dependencies for base snap %s for snap %s: %v", info.Base, snapName, err)
-            return nil, fmt.Errorf("failed to collect dependencies for base snap %s for snap %s: %v", info.Base, snapName, err) // Added 0 for int64
+            return nil, fmt.Errorf("failed to collect dependencies for base snap %s for snap %s: %w", info.Base, snapName, err) // Added 0 for int64
         }
         snapDetailsList = append(snapDetailsList, baseDetails...)
     }
@@ -174,6 +209,17 @@ func collectSnapDependencies(snapName, channel, fallbackChannel, snapsDir, asser
 func processSnap(snapDetails SnapDetails, snapsDir, assertionsDir string) error {
     verboseLog("Processing snap: %s on channel: %s", snapDetails.InstanceName, snapDetails.Channel)
 
+    started := time.Now()
+    if snapDetails.LocalPath != "" {
+        if err := copyLocalSnap(snapDetails, snapsDir); err != nil {
+            return err
+        }
+        recordSnapMethod(snapDetails.InstanceName, methodLocal, 0)
+        recordSnapElapsed(snapDetails.InstanceName, time.Since(started))
+        progressTracker.Advance(requestCost, fmt.Sprintf(G("Copied local snap %s"), snapDetails.InstanceName))
+        return nil
+    }
+
     // Proceed with downloading the snap (either full or delta) using downloadAndApplySnap
     snapInfo, err := downloadAndApplySnap(storeClient, snapDetails.Result, snapsDir, assertionsDir, snapDetails.CurrentSnap)
     if err != nil {
@@ -182,6 +228,7 @@ func processSnap(snapDetails SnapDetails, snapsDir, assertionsDir string) error
 
     // Mark the snap as required after successful download and application
     requiredSnaps[snapDetails.InstanceName] = true
+    recordSnapElapsed(snapDetails.InstanceName, time.Since(started))
     verboseLog("Downloaded and applied snap: %s, revision: %d", snapInfo.SuggestedName, snapInfo.Revision.N)
     return nil
 }
@@ -210,21 +257,27 @@ func fetchOrRefreshSnapInfo(snapName string, currentSnap *store.CurrentSnap, cha
     }
 
     results, _, err := storeClient.SnapAction(ctx, includeSnap, actions, nil, nil, nil)
+    storeLookups++
     if err != nil {
         verboseLog("SnapAction error for %s: %v", snapName, err)
         if (strings.Contains(err.Error(), "snap has no updates available") || strings.Contains(err.Error(), "no snap revision available as specified")) && currentSnap != nil {
             return nil, err
         }
-        return nil, fmt.Errorf("snap action failed for %s: %w", snapName, err)
+        return nil, &StoreError{Snap: snapName, Err: fmt.Errorf("snap action failed for %s: %w", snapName, err)}
     }
 
     if len(results) == 0 || results[0].Info == nil {
-        return nil, fmt.Errorf("no snap info returned for snap %s", snapName)
+        return nil, &StoreError{Snap: snapName, Err: fmt.Errorf("no snap info returned for snap %s", snapName)}
     }
 
     result := &results[0]
     info := result.Info
 
+    if err := checkConfinement(info); err != nil {
+        return nil, err
+    }
+    snapInfoMap[snapName] = info
+
     // Validate necessary fields in the snap information
     if info.SnapID == "" || info.Revision.N == 0 {
         return nil, fmt.Errorf("invalid snap information for %s: SnapID or Revision is missing", snapName)
@@ -234,6 +287,18 @@ func fetchOrRefreshSnapInfo(snapName string, currentSnap *store.CurrentSnap, cha
     return result, nil
 }
 
+// checkConfinement makes sure the model allows the confinement of a snap,
+// classic snaps can only be seeded for classic models
+func checkConfinement(info *snap.Info) error {
+    if info.NeedsClassic() && !seedModel.Classic() {
+        return &RequirementsError{
+            Snap: info.InstanceName(),
+            Err:  fmt.Errorf("cannot seed snap %s: it uses classic confinement, which model %s/%s does not allow", info.InstanceName(), seedModel.BrandID(), seedModel.Model()),
+        }
+    }
+    return nil
+}
+
 // findPreviousSnap locates the previous snap revision in the downloads directory.
 func findPreviousSnap(downloadDir, assertionsDir, snapName string) (string, *store.CurrentSnap) {
     var currentSnap store.CurrentSnap
@@ -14,16 +14,23 @@ package main
 
 import (
     "fmt"
+    "io"
+    "log"
+    "math"
+    "os"
     "sync"
+    "time"
     "github.com/snapcore/snapd/progress"
+    "github.com/snapcore/snapd/strutil"
 )
 
 var (
+    // progressOutput receives the progress lines, commands printing a report on standard output move it to standard error
+    progressOutput   io.Writer = os.Stdout
     progressReporter ProgressReporter
     progressTracker  *ProgressTracker
     globalDownloaded float64
     globalMu         sync.Mutex
-    lastReported     int
 )
 
 type ProgressReporter interface {
@@ -34,7 +41,7 @@ type ProgressReporter interface {
 type VerboseProgressReporter struct{}
 
 func (v *VerboseProgressReporter) Report(percentage int, status string) {
-    fmt.Printf("%d\t%s\n", percentage, status)
+    fmt.Fprintf(progressOutput, "%d\t%s\n", percentage, status)
 }
 
 // ProgressMeter tracks the download progress and implements the progress.Meter interface
@@ -45,8 +52,18 @@ type ProgressMeter struct {
     snapName     string
     snapVersion  string
     totalSize    float64
+    started      time.Time
+    lastEvent    time.Time
+    // rate is the moving average of the download speed in bytes per second,
+    // sampled from the bytes and time of the last sample
+    rate         float64
+    sampleBytes  float64
+    sampleTime   time.Time
 }
 
+// rateSmoothing is the weight of the newest sample in the moving average of the download rate
+const rateSmoothing = 0.3
+
 // Ensure ProgressMeter implements the progress.Meter interface
 var _ progress.Meter = (*ProgressMeter)(nil)
 
@@ -57,6 +74,8 @@ func NewProgressMeter(snapName string, snapVersion string, isDelta bool) *Progre
         snapName: snapName,
         snapVersion: snapVersion,
         totalSize: snapSizeMap[snapName],
+        started: time.Now(),
+        sampleTime: time.Now(),
     }
 }
 
@@ -65,6 +84,8 @@ func (pm *ProgressMeter) Start(label string, total float64) {
     pm.mu.Lock()
     defer pm.mu.Unlock()
     pm.totalSize = total
+    pm.started = time.Now()
+    pm.sampleTime = pm.started
 
     // Update global total size
     globalMu.Lock()
@@ -84,7 +105,10 @@ func (pm *ProgressMeter) Set(value float64) {
     globalDownloaded += delta
     globalMu.Unlock()
 
-    reportGlobalProgress(pm.snapName, pm.snapVersion, pm.isDelta)
+    recordSnapDownload(pm.snapName, delta)
+    pm.updateRate(time.Now())
+    pm.reportGlobalProgress(delta)
+    pm.emitDownload(false)
 }
 
 // SetTotal sets the total size for the ProgressMeter
@@ -107,7 +131,10 @@ func (pm *ProgressMeter) Finished() {
     globalDownloaded += delta
     globalMu.Unlock()
 
-    reportGlobalProgress(pm.snapName, pm.snapVersion, pm.isDelta)
+    recordSnapDownload(pm.snapName, delta)
+    pm.updateRate(time.Now())
+    pm.reportGlobalProgress(delta)
+    pm.emitDownload(true)
 }
 
 // Write handles byte data to update progress based on the size of the data written
@@ -124,60 +151,178 @@ func (pm *ProgressMeter) Write(p []byte) (n int, err error) {
     globalDownloaded += delta
     globalMu.Unlock()
 
-    reportGlobalProgress(pm.snapName, pm.snapVersion, pm.isDelta)
+    recordSnapDownload(pm.snapName, delta)
+    pm.updateRate(time.Now())
+    pm.reportGlobalProgress(delta)
+    pm.emitDownload(false)
 
     return len(p), nil
 }
 
-// reportGlobalProgress calculates and formats the overall progress percentage
-func reportGlobalProgress(snapName string, snapVersion string, isDelta bool) {
-    globalMu.Lock()
-    defer globalMu.Unlock()
+// emitDownload sends a download progress event, at most every downloadEventInterval unless final is set.
+// The caller holds pm.mu.
+func (pm *ProgressMeter) emitDownload(final bool) {
+    now := time.Now()
+    if !final && now.Sub(pm.lastEvent) < downloadEventInterval {
+        return
+    }
+    pm.lastEvent = now
 
-    if totalSnapSize == 0 {
+    method := methodFull
+    if pm.isDelta {
+        method = methodDelta
+    }
+    eta, etaTotal := pm.timeLeft()
+    emitEvent(progressEvent{
+        Type:     eventDownload,
+        Snap:     pm.snapName,
+        Revision: pm.snapVersion,
+        Method:   method,
+        Bytes:    int64(pm.currentBytes),
+        Total:    int64(pm.totalSize),
+        Rate:     pm.rate,
+        ETA:      eta,
+        ETATotal: etaTotal,
+    })
+}
+
+// updateRate takes a new sample of the download rate into the moving average, at most every
+// downloadEventInterval. The caller holds pm.mu.
+func (pm *ProgressMeter) updateRate(now time.Time) {
+    elapsed := now.Sub(pm.sampleTime).Seconds()
+    if elapsed < downloadEventInterval.Seconds() {
         return
     }
-    // Calculate the percentage within the range of 10 to 90
-    percentage := int((globalDownloaded / totalSnapSize) * 80) + 10
+    sample := (pm.currentBytes - pm.sampleBytes) / elapsed
+    if sample < 0 {
+        sample = 0
+    }
+    if pm.rate == 0 {
+        pm.rate = sample
+    } else {
+        pm.rate = rateSmoothing*sample + (1-rateSmoothing)*pm.rate
+    }
+    pm.sampleBytes = pm.currentBytes
+    pm.sampleTime = now
+}
+
+// timeLeft estimates the seconds left for this download and for all downloads of the run
+// at the current rate, zero while the rate is unknown. The caller holds pm.mu.
+func (pm *ProgressMeter) timeLeft() (float64, float64) {
+    if pm.rate <= 0 {
+        return 0, 0
+    }
+    globalMu.Lock()
+    remaining := totalSnapSize - globalDownloaded
+    globalMu.Unlock()
+    return math.Max(pm.totalSize-pm.currentBytes, 0) / pm.rate, math.Max(remaining, 0) / pm.rate
+}
 
-    // Only print if there's a change in percentage to reduce output
-    if percentage != lastReported {
-        lastReported = percentage
-        if isDelta {
-            progressString := fmt.Sprintf("Downloading delta for snap %s %s", snapName, snapVersion)
-            progressReporter.Report(percentage, progressString)
-        } else {
-            progressString := fmt.Sprintf("Downloading snap %s %s", snapName, snapVersion)
-            progressReporter.Report(percentage, progressString)
-        }
+// reportGlobalProgress advances the download step by newly downloaded bytes, showing the rate
+// and the time left once they are known. The caller holds pm.mu.
+func (pm *ProgressMeter) reportGlobalProgress(bytes float64) {
+    status := fmt.Sprintf(G("Downloading snap %s %s"), pm.snapName, pm.snapVersion)
+    if pm.isDelta {
+        status = fmt.Sprintf(G("Downloading delta for snap %s %s"), pm.snapName, pm.snapVersion)
+    }
+    if pm.rate > 0 {
+        eta, _ := pm.timeLeft()
+        status += " (" + fmt.Sprintf(G("%s/s, %s left"), strutil.SizeToStr(int64(pm.rate)), formatDuration(eta)) + ")"
     }
+    progressTracker.Advance(bytes/downloadRate, status)
+}
+
+// formatDuration formats seconds to the second, such as 1m5s
+func formatDuration(seconds float64) string {
+    return (time.Duration(seconds * float64(time.Second))).Round(time.Second).String()
 }
 
 // Spin shows indefinite activity; not used in this implementation
 func (pm *ProgressMeter) Spin(msg string) {
-    fmt.Printf("Spin: %s\n", msg)
+    if !emitEvent(progressEvent{Type: eventNotification, Snap: pm.snapName, Message: msg}) {
+        fmt.Fprintf(progressOutput, "Spin: %s\n", msg)
+    }
 }
 
-// Notify formats notifications about the progress
+// Notify formats notifications about the progress. Frontends parse the prefixes of these lines,
+// so only snapd's message is localized.
 func (pm *ProgressMeter) Notify(message string) {
-    fmt.Printf("Notification: %s\n", message)
+    if !emitEvent(progressEvent{Type: eventNotification, Snap: pm.snapName, Message: message}) {
+        fmt.Fprintf(progressOutput, "Notification: %s\n", message)
+    }
 }
 
-// ProgressTracker manages multiple steps of progress
+// ProgressTracker manages multiple steps of progress. Every step has a weight, its expected cost
+// in seconds, and counts its own units of work. The overall percentage never goes down.
 type ProgressTracker struct {
-    totalWeight     int
-    completedWeight float64
-    mu              sync.Mutex
-    reporter        ProgressReporter
-    steps           []*WeightedStep
-    currentStep     int
+    mu          sync.Mutex
+    reporter    ProgressReporter
+    steps       []*WeightedStep
+    currentStep int
+    // base is the percentage reached when the weights last changed, and baseDone the weighted
+    // work done at that point. Only the work after it is spread over the rest of the percentage.
+    base     float64
+    baseDone float64
+    // floor is the highest percentage calculated so far
+    floor        int
+    lastReported int
 }
 
-// WeightedStep represents a step in a multi-step progress tracker
+// WeightedStep represents a step in a multi-step progress tracker. Status is the untranslated
+// name of the step, which phase events carry as is.
 type WeightedStep struct {
-    Weight   int
-    Progress float64
-    Status   string
+    Weight float64
+    Total  float64
+    Done   float64
+    Status string
+}
+
+// complete marks all work of the step as done, a step without any work counts as one unit
+func (step *WeightedStep) complete() {
+    if step.Total == 0 {
+        step.Total = 1
+    }
+    step.Done = step.Total
+}
+
+// Indexes of the steps set up by StartProgress
+const (
+    stepLoading = iota
+    stepResolving
+    stepDownloading
+    stepVerifying
+)
+
+// Costs of units of work in seconds, used to weigh the steps against each other
+const (
+    // defaultRequestCost stands in for the cost of a store request until one is measured
+    defaultRequestCost = 0.5
+    // downloadRate is the expected download speed in bytes per second
+    downloadRate = 10 * 1000 * 1000
+    // cleanupCost is the cost of removing a stale file
+    cleanupCost = 0.01
+    // validateSeedCost is the cost of snap debug validate-seed
+    validateSeedCost = 2.0
+    // assertionsPerSnap are the assertions fetched with every snap
+    assertionsPerSnap = 4
+    // seedAssertions are the model, account-key and account assertions of the seed
+    seedAssertions = 3
+)
+
+var (
+    // requestCost is the cost of a single store request, measured while resolving the seed
+    requestCost = defaultRequestCost
+    // storeLookups counts the store requests made while resolving the seed
+    storeLookups int
+)
+
+// measureRequestCost works out the cost of a store request from the time resolving the seed took
+func measureRequestCost(elapsed time.Duration) {
+    if storeLookups == 0 {
+        return
+    }
+    requestCost = elapsed.Seconds() / float64(storeLookups)
+    verboseLog("Store requests took %.2fs on average", requestCost)
 }
 
 // NewProgressTracker creates a new instance of ProgressTracker
@@ -188,15 +333,15 @@ func NewProgressTracker(reporter ProgressReporter) *ProgressTracker {
     }
 }
 
-// AddStep adds a new step to the progress tracker
-func (pt *ProgressTracker) AddStep(weight int, status string) {
+// AddStep adds a new step to the progress tracker, with a single unit of work until told otherwise
+func (pt *ProgressTracker) AddStep(weight float64, status string) {
     pt.mu.Lock()
     defer pt.mu.Unlock()
     pt.steps = append(pt.steps, &WeightedStep{
         Weight: weight,
+        Total:  1,
         Status: status,
     })
-    pt.totalWeight += weight
 }
 
 // Start initializes the first step of the tracker
@@ -205,29 +350,58 @@ func (pt *ProgressTracker) Start() {
     defer pt.mu.Unlock()
     if len(pt.steps) > 0 {
         pt.currentStep = 0
-        pt.steps[pt.currentStep].Progress = 0
-        pt.reportProgress()
+        pt.emitPhase(eventPhaseStart, "")
+        pt.reportProgress("")
     }
 }
 
-// UpdateStepProgress updates the current step's progress
-func (pt *ProgressTracker) UpdateStepProgress(progress float64) {
+// SetStep sets the weight and the units of work of a step once they are known
+func (pt *ProgressTracker) SetStep(index int, weight, total float64) {
+    pt.mu.Lock()
+    defer pt.mu.Unlock()
+    if index >= len(pt.steps) {
+        return
+    }
+    pt.rebase(func() {
+        pt.steps[index].Weight = weight
+        pt.steps[index].Total = total
+    })
+}
+
+// AddWork adds units of work and their weight to the current step, as more work turns up
+func (pt *ProgressTracker) AddWork(units, weight float64) {
     pt.mu.Lock()
     defer pt.mu.Unlock()
     if pt.currentStep >= len(pt.steps) {
         return
     }
     step := pt.steps[pt.currentStep]
-    if progress < 0 {
-        progress = float64(int((globalDownloaded / totalSnapSize) * float64(step.Weight)))
-    } else if progress < step.Progress {
+    pt.rebase(func() {
+        step.Weight += weight
+        step.Total += units
+    })
+}
+
+// Advance marks units of work of the current step as done and reports the new percentage,
+// if it changed, with status or the status of the step
+func (pt *ProgressTracker) Advance(units float64, status string) {
+    pt.mu.Lock()
+    defer pt.mu.Unlock()
+    if pt.currentStep >= len(pt.steps) || units <= 0 {
         return
     }
-    // Adjust delta calculation
-    delta := (progress - step.Progress)
-    pt.completedWeight += delta
-    step.Progress = progress
-    //pt.reportProgress()
+    step := pt.steps[pt.currentStep]
+    step.Done = math.Min(step.Done+units, step.Total)
+    pt.reportProgress(status)
+}
+
+// ReportStatus reports the current percentage with a new status
+func (pt *ProgressTracker) ReportStatus(status string) {
+    pt.mu.Lock()
+    defer pt.mu.Unlock()
+    percentage := pt.calculatePercentage()
+    pt.reporter.Report(percentage, status)
+    pt.lastReported = percentage
 }
 
 func (pt *ProgressTracker) Finish(status string) {
@@ -236,63 +410,149 @@ func (pt *ProgressTracker) Finish(status string) {
     if len(pt.steps) == 0 || pt.currentStep >= len(pt.steps) {
         return
     }
-    step := pt.steps[pt.currentStep]
-    if step.Progress < 100.0 {
-        // Corrected calculation to prevent exceeding 100%
-        remainingProgress := 100.0 - step.Progress
-        delta := (remainingProgress * float64(step.Weight)) / 100.0
-        pt.completedWeight += delta
-        step.Progress = 100.0
-    }
+    pt.steps[pt.currentStep].complete()
     percentage := pt.calculatePercentage()
     pt.reporter.Report(percentage, status)
+    pt.lastReported = percentage
+    pt.emitPhase(eventPhaseEnd, status)
     if pt.currentStep < len(pt.steps)-1 {
         pt.currentStep++
-        pt.steps[pt.currentStep].Progress = 0
-        pt.reportProgress()
+        pt.emitPhase(eventPhaseStart, "")
+        pt.reportProgress("")
     }
 }
 
-// NextStep moves to the next step in the progress tracker
+// NextStep skips the rest of the current step and moves to the next one
 func (pt *ProgressTracker) NextStep() {
     pt.mu.Lock()
     defer pt.mu.Unlock()
     if pt.currentStep < len(pt.steps)-1 {
+        pt.steps[pt.currentStep].complete()
+        pt.emitPhase(eventPhaseEnd, G("Skipped"))
         pt.currentStep++
-        pt.steps[pt.currentStep].Progress = 0
-        pt.reportProgress()
+        pt.emitPhase(eventPhaseStart, "")
+        pt.reportProgress("")
     }
 }
 
-// calculatePercentage calculates the overall progress as a percentage
-func (pt *ProgressTracker) calculatePercentage() int {
-    if pt.totalWeight == 0 {
-        return 0
+// emitPhase sends a phase event for the current step. The caller holds pt.mu.
+func (pt *ProgressTracker) emitPhase(eventType, message string) {
+    reporter, ok := pt.reporter.(EventReporter)
+    if !ok {
+        return
+    }
+    reporter.Event(progressEvent{
+        Type:    eventType,
+        Percent: pt.calculatePercentage(),
+        Phase:   pt.steps[pt.currentStep].Status,
+        Message: message,
+    })
+}
+
+// rebase changes weights without moving the percentage: the percentage reached so far is kept,
+// and only the work left is spread over the rest. The caller holds pt.mu.
+func (pt *ProgressTracker) rebase(change func()) {
+    pt.base = pt.exactPercentage()
+    change()
+    pt.baseDone = pt.weightedDone()
+}
+
+// weightedDone is the work done over all steps, in units of weight. Steps before the current one
+// are done, however little of their work turned up. The caller holds pt.mu.
+func (pt *ProgressTracker) weightedDone() float64 {
+    done := 0.0
+    for i, step := range pt.steps {
+        if i < pt.currentStep {
+            done += step.Weight
+        } else if step.Total > 0 {
+            done += step.Weight * step.Done / step.Total
+        }
+    }
+    return done
+}
+
+// exactPercentage is the overall progress since the last rebase. The caller holds pt.mu.
+func (pt *ProgressTracker) exactPercentage() float64 {
+    totalWeight := 0.0
+    for _, step := range pt.steps {
+        totalWeight += step.Weight
     }
-    // Calculate percentage accurately and scale within 0-99 range
-    percentage := int((pt.completedWeight / float64(pt.totalWeight)) * 100)
+    remaining := totalWeight - pt.baseDone
+    if remaining <= 0 {
+        return pt.base
+    }
+    return pt.base + (100-pt.base)*(pt.weightedDone()-pt.baseDone)/remaining
+}
+
+// calculatePercentage calculates the overall progress as a percentage in the 0-99 range,
+// never lower than before. The caller holds pt.mu.
+func (pt *ProgressTracker) calculatePercentage() int {
+    percentage := int(pt.exactPercentage())
     if percentage > 99 {
         percentage = 99
     }
+    if percentage < pt.floor {
+        percentage = pt.floor
+    }
+    pt.floor = percentage
     return percentage
 }
 
-// reportProgress reports the current progress percentage to the reporter
-func (pt *ProgressTracker) reportProgress() {
+// reportProgress reports the current percentage to the reporter if it changed. The caller holds pt.mu.
+func (pt *ProgressTracker) reportProgress(status string) {
     percentage := pt.calculatePercentage()
-    status := pt.steps[pt.currentStep].Status
-    if percentage != lastReported {
+    if status == "" {
+        status = G(pt.steps[pt.currentStep].Status)
+    }
+    if percentage != pt.lastReported {
         pt.reporter.Report(percentage, status)
-        lastReported = percentage
+        pt.lastReported = percentage
+    }
+}
+
+// weighRemainingSteps weighs the download and verification steps by the work the resolved seed needs
+func weighRemainingSteps(snapsToProcess []SnapDetails) {
+    download := totalSnapSize / downloadRate
+    for _, details := range snapsToProcess {
+        if details.LocalPath != "" {
+            download += requestCost
+        } else {
+            download += assertionsPerSnap * requestCost
+        }
     }
+    // Every replaced snap leaves a snap and an assertion file behind
+    verify := seedAssertions*requestCost + float64(2*len(snapsToProcess))*cleanupCost + validateSeedCost
+    progressTracker.SetStep(stepDownloading, download, download)
+    progressTracker.SetStep(stepVerifying, verify, verify)
 }
 
-// InitProgress initializes the global progress tracker and sets up steps
-func InitProgress() {
-    progressReporter = &VerboseProgressReporter{}
+// InitProgress sets up the progress reporter for the given output format
+func InitProgress(format string) {
+    switch {
+    case format == progressFormatJSONL:
+        progressReporter = NewJSONLinesProgressReporter(progressOutput)
+    case format == progressFormatAuto && isTerminal(progressOutput):
+        // Everything else printed while the live display is up goes above it
+        terminal := NewTerminalProgressReporter(progressOutput.(*os.File))
+        progressOutput = terminal.passthrough(progressOutput)
+        log.SetOutput(terminal.passthrough(os.Stderr))
+        progressReporter = terminal
+    default:
+        progressReporter = &VerboseProgressReporter{}
+    }
+}
+
+// StartProgress initializes the global progress tracker and sets up steps. Listeners get every
+// progress update and event from now on in addition to the progress output.
+func StartProgress(listeners ...EventReporter) {
+    if len(listeners) > 0 {
+        progressReporter = &fanoutProgressReporter{primary: progressReporter, listeners: listeners}
+    }
+    // The weights are rough guesses until the seed is resolved
     progressTracker = NewProgressTracker(progressReporter)
-    progressTracker.AddStep(10, "Initialization")
-    progressTracker.AddStep(80, "Downloading snaps")
-    progressTracker.AddStep(10, "Verifying snaps")
+    progressTracker.AddStep(1, N_("Loading the seed"))
+    progressTracker.AddStep(5, N_("Resolving snaps"))
+    progressTracker.AddStep(60, N_("Downloading snaps"))
+    progressTracker.AddStep(5, N_("Verifying snaps"))
     progressTracker.Start()
 }
@@ -0,0 +1,173 @@
+// Copyright (C) 2024 Simon Quigley <tsimonq2@ubuntu.com>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 3
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+package main
+
+import (
+    "fmt"
+    "sort"
+    "strings"
+
+    "github.com/snapcore/snapd/snap"
+)
+
+// anySnap in a provider override applies it to every snap
+const anySnap = "*"
+
+var (
+    // providerOverrides maps "snap:tag" to the content provider used instead of the declared default-provider
+    providerOverrides = make(map[string]string)
+    // excludedProviders are content providers that are never pulled into the seed
+    excludedProviders = make(map[string]bool)
+    // excludedContent lists the content tags left without their provider by an exclusion
+    excludedContent []contentTag
+    // overriddenContent lists the content tags whose provider was replaced by an override
+    overriddenContent []contentTag
+)
+
+// contentTag is a content tag of a snap together with the provider chosen for it
+type contentTag struct {
+    Snap     string
+    Tag      string
+    Provider string
+}
+
+// providerOverrideFlag is a flag.Value for SNAP:TAG=PROVIDER overrides
+type providerOverrideFlag struct{}
+
+func (providerOverrideFlag) String() string {
+    var overrides []string
+    for key, provider := range providerOverrides {
+        overrides = append(overrides, key+"="+provider)
+    }
+    sort.Strings(overrides)
+    return strings.Join(overrides, ",")
+}
+
+func (providerOverrideFlag) Set(value string) error {
+    key, provider, found := strings.Cut(value, "=")
+    snapName, tag, hasTag := strings.Cut(key, ":")
+    if !found || !hasTag || snapName == "" || tag == "" || provider == "" {
+        return fmt.Errorf("expected SNAP:TAG=PROVIDER, got %q", value)
+    }
+    providerOverrides[key] = provider
+    return nil
+}
+
+// excludeFlag is a flag.Value collecting excluded content providers
+type excludeFlag struct{}
+
+func (excludeFlag) String() string {
+    var names []string
+    for name := range excludedProviders {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return strings.Join(names, ",")
+}
+
+func (excludeFlag) Set(value string) error {
+    excludedProviders[value] = true
+    return nil
+}
+
+// contentProvider returns the provider to use for a content tag of a snap, honouring the overrides
+func contentProvider(snapName, tag, defaultProvider string) string {
+    if provider, ok := providerOverrides[snapName+":"+tag]; ok {
+        return provider
+    }
+    if provider, ok := providerOverrides[anySnap+":"+tag]; ok {
+        return provider
+    }
+    return defaultProvider
+}
+
+// resolveContentProviders applies the overrides and exclusions to the content default-providers
+// of a snap, as returned by SimplePrereqTracker, and returns the providers to pull in with their tags.
+// The overridden and excluded content tags are recorded for warnUnsatisfiedContent.
+func resolveContentProviders(snapName string, missingPrereqs map[string][]string) map[string][]string {
+    providers, overridden, excluded := chooseContentProviders(snapName, missingPrereqs)
+    for _, content := range overridden {
+        verboseLog("Using %s for content %s of %s instead of its default-provider", content.Provider, content.Tag, snapName)
+    }
+    for _, content := range excluded {
+        verboseLog("Not pulling in %s for content %s of %s, it is excluded", content.Provider, content.Tag, snapName)
+    }
+    overriddenContent = append(overriddenContent, overridden...)
+    excludedContent = append(excludedContent, excluded...)
+    return providers
+}
+
+// chooseContentProviders works out the providers to pull in for the content default-providers of a
+// snap, along with the content tags whose provider was overridden or excluded, without recording them
+func chooseContentProviders(snapName string, missingPrereqs map[string][]string) (map[string][]string, []contentTag, []contentTag) {
+    providers := make(map[string][]string)
+    var overridden, excluded []contentTag
+    for defaultProvider, tags := range missingPrereqs {
+        for _, tag := range tags {
+            provider := contentProvider(snapName, tag, defaultProvider)
+            if provider != defaultProvider {
+                overridden = append(overridden, contentTag{Snap: snapName, Tag: tag, Provider: provider})
+            }
+            if excludedProviders[provider] {
+                excluded = append(excluded, contentTag{Snap: snapName, Tag: tag, Provider: provider})
+                continue
+            }
+            providers[provider] = append(providers[provider], tag)
+        }
+    }
+    return providers, overridden, excluded
+}
+
+// warnUnsatisfiedContent warns about content plugs that no snap of the resolved seed provides
+// because their provider was excluded, or replaced by a snap without a matching slot
+func warnUnsatisfiedContent() {
+    for _, overridden := range overriddenContent {
+        if info := snapInfoMap[overridden.Provider]; info != nil && !providesContent(info, overridden.Tag) {
+            warnf("Content %s of %s is not provided by %s, which replaces its default-provider", overridden.Tag, overridden.Snap, overridden.Provider)
+        }
+    }
+    for _, excluded := range excludedContent {
+        if contentProvidedBySeed(excluded.Tag) {
+            continue
+        }
+        warnf("Content %s of %s is not provided by any snap in the seed, its provider %s is excluded", excluded.Tag, excluded.Snap, excluded.Provider)
+    }
+}
+
+// contentProvidedBySeed checks whether any snap of the resolved seed has a content slot for the tag
+func contentProvidedBySeed(tag string) bool {
+    for name, info := range snapInfoMap {
+        if requiredSnaps[name] && providesContent(info, tag) {
+            return true
+        }
+    }
+    return false
+}
+
+// providesContent checks whether a snap has a content slot for the tag
+func providesContent(info *snap.Info, tag string) bool {
+    for _, slot := range info.Slots {
+        if slot.Interface != "content" {
+            continue
+        }
+        // The content attribute defaults to the slot name
+        content, ok := slot.Attrs["content"].(string)
+        if !ok {
+            content = slot.Name
+        }
+        if content == tag {
+            return true
+        }
+    }
+    return false
+}
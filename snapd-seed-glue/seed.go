@@ -15,20 +15,40 @@ package main
 import (
     "fmt"
     "io/ioutil"
-    "log"
     "os"
+    "path/filepath"
+    "sort"
     "strings"
 
     "gopkg.in/yaml.v3"
     "github.com/snapcore/snapd/store"
 )
 
+// requestedSnapsFile lists, next to seed.yaml, the snaps of the seed asked for by name rather than
+// pulled in by others. seed.yaml follows snapd's format, so it has no place for this.
+const requestedSnapsFile = "requested-snaps"
+
+// seedSnap is a single entry of the snaps list in seed.yaml
+type seedSnap struct {
+    Name       string `yaml:"name"`
+    ID         string `yaml:"id,omitempty"`
+    Channel    string `yaml:"channel,omitempty"`
+    File       string `yaml:"file"`
+    Classic    bool   `yaml:"classic,omitempty"`
+    DevMode    bool   `yaml:"devmode,omitempty"`
+    Unasserted bool   `yaml:"unasserted,omitempty"`
+    Contact    string `yaml:"contact,omitempty"`
+}
+
 type seed struct {
-    Snaps []struct {
-        Name    string `yaml:"name"`
-        Channel string `yaml:"channel"`
-        File    string `yaml:"file"`
-    } `yaml:"snaps"`
+    Snaps []*seedSnap `yaml:"snaps"`
+}
+
+// seedDocument holds seed.yaml as a yaml.v3 node tree, so keys we don't know
+// about and any comments survive when the file is written back
+type seedDocument struct {
+    root  *yaml.Node
+    snaps *yaml.Node
 }
 
 // getChannelName returns the channel name for a specific snap name
@@ -56,7 +76,7 @@ func initializeSeedYaml() {
     if _, err := os.Stat(seedYaml); os.IsNotExist(err) {
         file, err := os.Create(seedYaml)
         if err != nil {
-            log.Fatalf("Failed to create seed.yaml: %v", err)
+            failf(errKindSeed, "Failed to create seed.yaml: %v", err)
         }
         defer file.Close()
         file.WriteString("snaps:\n")
@@ -67,32 +87,35 @@ func initializeSeedYaml() {
 func loadSeedData() seed {
     file, err := ioutil.ReadFile(seedYaml)
     if err != nil {
-        log.Fatalf("Failed to read seed.yaml: %v", err)
+        failf(errKindSeed, "Failed to read seed.yaml: %v", err)
     }
 
     var seedData seed
     if err := yaml.Unmarshal(file, &seedData); err != nil {
-        log.Fatalf("Failed to parse seed.yaml: %v", err)
+        failf(errKindSeed, "Failed to parse seed.yaml: %v", err)
     }
 
     return seedData
 }
 
-// loadExistingSnaps loads snaps from seed.yaml into a map
-func loadExistingSnaps() map[string]bool {
+// loadExistingSnaps loads the entries of seed.yaml into a map by snap name
+func loadExistingSnaps() map[string]*seedSnap {
+    existing := make(map[string]*seedSnap)
     file, err := ioutil.ReadFile(seedYaml)
+    if os.IsNotExist(err) {
+        return existing
+    }
     if err != nil {
-        log.Fatalf("Failed to read seed.yaml: %v", err)
+        failf(errKindSeed, "Failed to read seed.yaml: %v", err)
     }
 
     var seedData seed
     if err := yaml.Unmarshal(file, &seedData); err != nil {
-        log.Fatalf("Failed to parse seed.yaml: %v", err)
+        failf(errKindSeed, "Failed to parse seed.yaml: %v", err)
     }
 
-    existing := make(map[string]bool)
     for _, snap := range seedData.Snaps {
-        existing[snap.Name] = true
+        existing[snap.Name] = snap
         verboseLog("Found %s in seed.yaml\n", snap.Name)
     }
     return existing
@@ -100,56 +123,262 @@ func loadExistingSnaps() map[string]bool {
 
 // updateSeedYaml updates the seed.yaml file with the current required snaps
 func updateSeedYaml(snapsDir string, currentSnaps []*store.CurrentSnap) error {
+    updatedYAML, err := renderSeedYaml(currentSnaps)
+    if err != nil {
+        return err
+    }
+    return writeSeedYaml(updatedYAML)
+}
+
+// writeSeedYaml replaces the content of seed.yaml
+func writeSeedYaml(content []byte) error {
+    if err := ioutil.WriteFile(seedYaml, content, 0644); err != nil {
+        return fmt.Errorf("failed to write updated seed.yaml: %w", err)
+    }
+
+    verboseLog("Updated seed.yaml with current snaps.")
+    return nil
+}
+
+// requestedSeedSnaps returns the names of the requested snaps among the given seed snaps
+func requestedSeedSnaps(currentSnaps []*store.CurrentSnap) []string {
+    names := []string{}
+    for _, snapInfo := range currentSnaps {
+        if requestedSnaps[snapInfo.InstanceName] {
+            names = append(names, snapInfo.InstanceName)
+        }
+    }
+    sort.Strings(names)
+    return names
+}
+
+// loadRequestedSnaps reads the snaps recorded as requested next to seed.yaml.
+// It returns false for a seed written before they were recorded.
+func loadRequestedSnaps() (map[string]bool, bool) {
+    content, err := ioutil.ReadFile(filepath.Join(filepath.Dir(seedYaml), requestedSnapsFile))
+    if os.IsNotExist(err) {
+        return nil, false
+    }
+    if err != nil {
+        failf(errKindSeed, "Failed to read the requested snaps: %v", err)
+    }
+    requested := make(map[string]bool)
+    for _, name := range strings.Fields(string(content)) {
+        requested[name] = true
+    }
+    return requested, true
+}
+
+// writeRequestedSnaps records the requested snaps next to seed.yaml
+func writeRequestedSnaps(names []string) error {
+    content := strings.Join(names, "\n")
+    if content != "" {
+        content += "\n"
+    }
+    if err := ioutil.WriteFile(filepath.Join(filepath.Dir(seedYaml), requestedSnapsFile), []byte(content), 0644); err != nil {
+        return fmt.Errorf("failed to write %s: %w", requestedSnapsFile, err)
+    }
+    return nil
+}
+
+// renderSeedYaml returns the content seed.yaml will have once it lists exactly the given snaps
+func renderSeedYaml(currentSnaps []*store.CurrentSnap) ([]byte, error) {
     // Log the snaps to be written
     verboseLog("CurrentSnaps to be written to seed.yaml:")
     for _, snapInfo := range currentSnaps {
-        verboseLog("- %s_%d.snap", snapInfo.InstanceName, snapInfo.Revision.N)
+        verboseLog("- %s_%s.snap", snapInfo.InstanceName, snapInfo.Revision)
     }
 
     // Load existing seed data
-    file, err := ioutil.ReadFile(seedYaml)
+    seedDoc, err := loadSeedDocument(seedYaml)
     if err != nil {
-        return fmt.Errorf("failed to read seed.yaml: %w", err)
+        return nil, err
     }
 
-    var seedData seed
-    if err := yaml.Unmarshal(file, &seedData); err != nil {
-        return fmt.Errorf("failed to parse seed.yaml: %w", err)
+    // Merge currentSnaps into the existing entries, dropping the ones no longer required
+    wanted := make(map[string]bool)
+    for _, snapInfo := range currentSnaps {
+        snapFileName := fmt.Sprintf("%s_%s.snap", snapInfo.InstanceName, snapInfo.Revision)
+        entry := &seedSnap{
+            Name:       snapInfo.InstanceName,
+            Channel:    strings.Replace(snapInfo.TrackingChannel, "latest/", "", -1),
+            File:       snapFileName,
+            Unasserted: localSnaps[snapInfo.InstanceName],
+        }
+        info := snapInfoMap[snapInfo.InstanceName]
+        if info != nil && info.NeedsClassic() {
+            entry.Classic = true
+        }
+        if err := seedDoc.mergeEntry(entry); err != nil {
+            return nil, err
+        }
+        if info != nil {
+            // We know the snap's confinement and origin now, so stale flags must go
+            if !entry.Classic {
+                seedDoc.removeEntryField(entry.Name, "classic")
+            }
+            if entry.Unasserted {
+                seedDoc.removeEntryField(entry.Name, "channel")
+            } else {
+                seedDoc.removeEntryField(entry.Name, "unasserted")
+            }
+        }
+        wanted[snapInfo.InstanceName] = true
     }
+    seedDoc.retainEntries(wanted)
 
-    // Clear existing snaps
-    seedData.Snaps = []struct {
-        Name    string `yaml:"name"`
-        Channel string `yaml:"channel"`
-        File    string `yaml:"file"`
-    }{}
+    // Marshal the updated document back to YAML
+    updatedYAML, err := seedDoc.bytes()
+    if err != nil {
+        return nil, fmt.Errorf("failed to marshal updated seed data: %w", err)
+    }
+    return updatedYAML, nil
+}
 
-    // Populate seedData with currentSnaps
-    for _, snapInfo := range currentSnaps {
-        snapFileName := fmt.Sprintf("%s_%d.snap", snapInfo.InstanceName, snapInfo.Revision.N)
-        snapData := struct {
-            Name    string `yaml:"name"`
-            Channel string `yaml:"channel"`
-            File    string `yaml:"file"`
-        }{
-            Name:    snapInfo.InstanceName,
-            Channel: strings.Replace(snapInfo.TrackingChannel, "latest/", "", -1),
-            File:    snapFileName,
+// loadSeedDocument reads seed.yaml into a seedDocument
+func loadSeedDocument(path string) (*seedDocument, error) {
+    file, err := ioutil.ReadFile(path)
+    if os.IsNotExist(err) {
+        // Nothing has been seeded yet
+        return parseSeedDocument(nil)
+    }
+    if err != nil {
+        return nil, fmt.Errorf("failed to read seed.yaml: %w", err)
+    }
+    return parseSeedDocument(file)
+}
+
+// parseSeedDocument parses seed.yaml content, creating the snaps list if it is missing or empty
+func parseSeedDocument(data []byte) (*seedDocument, error) {
+    var root yaml.Node
+    if err := yaml.Unmarshal(data, &root); err != nil {
+        return nil, fmt.Errorf("failed to parse seed.yaml: %w", err)
+    }
+
+    // An empty file has no document node at all
+    if root.Kind == 0 {
+        root = yaml.Node{Kind: yaml.DocumentNode}
+    }
+    if len(root.Content) == 0 {
+        root.Content = []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}
+    }
+    top := root.Content[0]
+    if top.Kind != yaml.MappingNode {
+        return nil, fmt.Errorf("failed to parse seed.yaml: top level is not a mapping")
+    }
+
+    snaps := mappingValue(top, "snaps")
+    if snaps == nil {
+        snaps = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+        top.Content = append(top.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "snaps"}, snaps)
+    } else if snaps.Kind == yaml.ScalarNode && snaps.Tag == "!!null" {
+        // "snaps:" with nothing below it, as written by initializeSeedYaml
+        *snaps = yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", HeadComment: snaps.HeadComment, LineComment: snaps.LineComment, FootComment: snaps.FootComment}
+    } else if snaps.Kind != yaml.SequenceNode {
+        return nil, fmt.Errorf("failed to parse seed.yaml: snaps is not a list")
+    }
+
+    return &seedDocument{root: &root, snaps: snaps}, nil
+}
+
+// entries decodes every snap entry of the document
+func (d *seedDocument) entries() ([]*seedSnap, error) {
+    var entries []*seedSnap
+    for _, node := range d.snaps.Content {
+        entry := &seedSnap{}
+        if err := node.Decode(entry); err != nil {
+            return nil, fmt.Errorf("failed to parse snap entry in seed.yaml: %w", err)
         }
-        seedData.Snaps = append(seedData.Snaps, snapData)
+        entries = append(entries, entry)
     }
+    return entries, nil
+}
 
-    // Marshal the updated seedData back to YAML
-    updatedYAML, err := yaml.Marshal(&seedData)
-    if err != nil {
-        return fmt.Errorf("failed to marshal updated seed data: %w", err)
+// findEntry returns the mapping node of the snap with the given name, or nil
+func (d *seedDocument) findEntry(snapName string) *yaml.Node {
+    for _, node := range d.snaps.Content {
+        if name := mappingValue(node, "name"); name != nil && name.Value == snapName {
+            return node
+        }
     }
+    return nil
+}
 
-    // Write the updated YAML back to seed.yaml
-    if err := ioutil.WriteFile(seedYaml, updatedYAML, 0644); err != nil {
-        return fmt.Errorf("failed to write updated seed.yaml: %w", err)
+// mergeEntry adds a snap entry, or updates the fields set in entry on an existing one.
+// Keys that are unset in entry are left as they are.
+func (d *seedDocument) mergeEntry(entry *seedSnap) error {
+    var encoded yaml.Node
+    if err := encoded.Encode(entry); err != nil {
+        return fmt.Errorf("failed to encode seed entry for %s: %w", entry.Name, err)
     }
 
-    verboseLog("Updated seed.yaml with current snaps.")
+    node := d.findEntry(entry.Name)
+    if node == nil {
+        d.snaps.Content = append(d.snaps.Content, &encoded)
+        return nil
+    }
+    for i := 0; i+1 < len(encoded.Content); i += 2 {
+        setMappingValue(node, encoded.Content[i].Value, encoded.Content[i+1])
+    }
+    return nil
+}
+
+// removeEntryField deletes a single key from the entry of the given snap
+func (d *seedDocument) removeEntryField(snapName, key string) {
+    node := d.findEntry(snapName)
+    if node == nil {
+        return
+    }
+    for i := 0; i+1 < len(node.Content); i += 2 {
+        if node.Content[i].Value == key {
+            node.Content = append(node.Content[:i], node.Content[i+2:]...)
+            return
+        }
+    }
+}
+
+// retainEntries drops every snap entry whose name is not in wanted
+func (d *seedDocument) retainEntries(wanted map[string]bool) {
+    var kept []*yaml.Node
+    for _, node := range d.snaps.Content {
+        name := mappingValue(node, "name")
+        if name != nil && wanted[name.Value] {
+            kept = append(kept, node)
+        } else if name != nil {
+            verboseLog("Dropping %s from seed.yaml", name.Value)
+        }
+    }
+    d.snaps.Content = kept
+}
+
+// bytes renders the document back to YAML
+func (d *seedDocument) bytes() ([]byte, error) {
+    return yaml.Marshal(d.root)
+}
+
+// mappingValue returns the value node for key in a mapping node, or nil
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+    if node.Kind != yaml.MappingNode {
+        return nil
+    }
+    for i := 0; i+1 < len(node.Content); i += 2 {
+        if node.Content[i].Value == key {
+            return node.Content[i+1]
+        }
+    }
     return nil
 }
+
+// setMappingValue replaces the value of key in a mapping node, appending the key if needed.
+// Comments attached to an existing value are carried over.
+func setMappingValue(node *yaml.Node, key string, value *yaml.Node) {
+    for i := 0; i+1 < len(node.Content); i += 2 {
+        if node.Content[i].Value == key {
+            old := node.Content[i+1]
+            value.HeadComment, value.LineComment, value.FootComment = old.HeadComment, old.LineComment, old.FootComment
+            node.Content[i+1] = value
+            return
+        }
+    }
+    node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+}
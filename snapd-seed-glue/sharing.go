@@ -0,0 +1,285 @@
+// Copyright (C) 2024 Simon Quigley <tsimonq2@ubuntu.com>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 3
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "regexp"
+    "sort"
+    "strings"
+
+    "github.com/snapcore/snapd/snap"
+    "github.com/snapcore/snapd/store"
+    "github.com/snapcore/snapd/strutil"
+)
+
+// platformVersionExp matches the version parts of platform snap names, such as 42, 2204 or core22
+var platformVersionExp = regexp.MustCompile(`^(\d+|core\d+)$`)
+
+// sharedSnap is a base or content snap together with the apps that need it
+type sharedSnap struct {
+    Name string `json:"name"`
+    Role string `json:"role"`
+    Size int64  `json:"size"`
+    // Share is the fraction of the total seed size taken by the snap
+    Share float64  `json:"share"`
+    Apps  []string `json:"apps"`
+}
+
+// channelAlternative is a channel of an app that would let it use a platform snap already used by other apps
+type channelAlternative struct {
+    App      string   `json:"app"`
+    Channel  string   `json:"channel"`
+    Replaces string   `json:"replaces"`
+    Uses     string   `json:"uses"`
+    SharedBy []string `json:"shared-by"`
+}
+
+// sharingReport shows how well the apps of the seed share bases and content snaps
+type sharingReport struct {
+    TotalSize    int64                `json:"total-size"`
+    Snaps        []sharedSnap         `json:"snaps"`
+    Alternatives []channelAlternative `json:"alternatives"`
+}
+
+// buildSharingReport builds the sharing report from the resolved seed and its dependency edges
+func buildSharingReport() sharingReport {
+    report := sharingReport{Snaps: []sharedSnap{}, Alternatives: []channelAlternative{}}
+    graph := buildSeedGraph()
+    for _, node := range graph.Nodes {
+        report.TotalSize += node.Size
+    }
+
+    users := snapUsers()
+    for _, node := range graph.Nodes {
+        if node.Role != roleBase && node.Role != roleContent {
+            continue
+        }
+        shared := sharedSnap{Name: node.Name, Role: node.Role, Size: node.Size, Apps: users[node.Name]}
+        if shared.Apps == nil {
+            shared.Apps = []string{}
+        }
+        if report.TotalSize > 0 {
+            shared.Share = float64(node.Size) / float64(report.TotalSize)
+        }
+        report.Snaps = append(report.Snaps, shared)
+    }
+    sort.SliceStable(report.Snaps, func(i, j int) bool {
+        return report.Snaps[i].Size > report.Snaps[j].Size
+    })
+
+    report.Alternatives = findChannelAlternatives(report.Snaps, users)
+    return report
+}
+
+// snapUsers maps every snap to the requested apps that need it directly or through other snaps
+func snapUsers() map[string][]string {
+    users := make(map[string][]string)
+    var apps []string
+    for name := range requestedSnaps {
+        if name != "snapd" && name != "bare" && requiredSnaps[name] {
+            apps = append(apps, name)
+        }
+    }
+    sort.Strings(apps)
+
+    for _, app := range apps {
+        seen := map[string]bool{app: true}
+        queue := []string{app}
+        for len(queue) > 0 {
+            name := queue[0]
+            queue = queue[1:]
+            for _, dep := range snapDependencies {
+                if dep.From != name || seen[dep.To] {
+                    continue
+                }
+                seen[dep.To] = true
+                users[dep.To] = append(users[dep.To], app)
+                queue = append(queue, dep.To)
+            }
+        }
+    }
+    return users
+}
+
+// platformFamily strips the version parts from a platform snap name, so gnome-42-2204 and
+// gnome-46-2404 both give gnome and core22 gives core
+func platformFamily(name string) string {
+    parts := strings.Split(name, "-")
+    for len(parts) > 1 && platformVersionExp.MatchString(parts[len(parts)-1]) {
+        parts = parts[:len(parts)-1]
+    }
+    if len(parts) == 1 {
+        return strings.TrimRight(parts[0], "0123456789")
+    }
+    return strings.Join(parts, "-")
+}
+
+// findChannelAlternatives looks for other channels of apps that would move them onto a platform snap
+// of the same family that other apps of the seed already use. Only apps that need the platform snap
+// themselves are considered, an app cannot change what the snaps it pulls in need.
+func findChannelAlternatives(shared []sharedSnap, users map[string][]string) []channelAlternative {
+    alternatives := []channelAlternative{}
+    seen := make(map[string]bool)
+
+    families := make(map[string][]string)
+    for _, s := range shared {
+        families[platformFamily(s.Name)] = append(families[platformFamily(s.Name)], s.Name)
+    }
+
+    for _, members := range families {
+        if len(members) < 2 {
+            continue
+        }
+        for _, current := range members {
+            for _, app := range users[current] {
+                if !dependsDirectly(app, current) {
+                    continue
+                }
+                for _, alternative := range appChannelAlternatives(app, current, members, users) {
+                    key := alternative.App + "\x00" + alternative.Channel + "\x00" + alternative.Replaces + "\x00" + alternative.Uses
+                    if !seen[key] {
+                        seen[key] = true
+                        alternatives = append(alternatives, alternative)
+                    }
+                }
+            }
+        }
+    }
+
+    sort.Slice(alternatives, func(i, j int) bool {
+        a, b := alternatives[i], alternatives[j]
+        switch {
+        case a.App != b.App:
+            return a.App < b.App
+        case a.Channel != b.Channel:
+            return a.Channel < b.Channel
+        case a.Replaces != b.Replaces:
+            return a.Replaces < b.Replaces
+        }
+        return a.Uses < b.Uses
+    })
+    return alternatives
+}
+
+// dependsDirectly checks whether a snap needs another one itself, as its base or for a content plug
+func dependsDirectly(from, to string) bool {
+    for _, dep := range snapDependencies {
+        if dep.From == from && dep.To == to {
+            return true
+        }
+    }
+    return false
+}
+
+// appChannelAlternatives checks the stable channels of an app for one that needs another member
+// of the platform family instead of current
+func appChannelAlternatives(app, current string, members []string, users map[string][]string) []channelAlternative {
+    var alternatives []channelAlternative
+
+    storeInfo, err := storeClient.SnapInfo(ctx, store.SnapSpec{Name: app}, nil)
+    if err != nil {
+        verboseLog("Failed to look up channels of %s: %v", app, err)
+        return nil
+    }
+    for channel := range storeInfo.Channels {
+        if !strings.HasSuffix(channel, "/stable") {
+            continue
+        }
+        info, err := fetchChannelInfo(app, channel)
+        if err != nil {
+            verboseLog("Failed to look up %s in %s: %v", app, channel, err)
+            continue
+        }
+        needs := snapPrereqNames(info)
+        if needs[current] {
+            continue
+        }
+        for _, other := range members {
+            if other == current || !needs[other] {
+                continue
+            }
+            alternatives = append(alternatives, channelAlternative{
+                App:      app,
+                Channel:  channel,
+                Replaces: current,
+                Uses:     other,
+                SharedBy: users[other],
+            })
+        }
+    }
+    return alternatives
+}
+
+// fetchChannelInfo looks up a snap in a channel without recording it as part of the seed
+func fetchChannelInfo(snapName, channel string) (*snap.Info, error) {
+    actions := []*store.SnapAction{{
+        Action:       "install",
+        InstanceName: snapName,
+        Channel:      channel,
+    }}
+    results, _, err := storeClient.SnapAction(ctx, nil, actions, nil, nil, nil)
+    if err != nil {
+        return nil, err
+    }
+    if len(results) == 0 || results[0].Info == nil {
+        return nil, fmt.Errorf("no snap info returned for snap %s", snapName)
+    }
+    return results[0].Info, nil
+}
+
+// snapPrereqNames returns the base and the content providers a snap would pull into the seed,
+// after the provider overrides and exclusions
+func snapPrereqNames(info *snap.Info) map[string]bool {
+    names := make(map[string]bool)
+    tracker := snap.SimplePrereqTracker{}
+    providers, _, _ := chooseContentProviders(info.InstanceName(), tracker.MissingProviderContentTags(info, nil))
+    for provider := range providers {
+        names[provider] = true
+    }
+    if info.Base != "" {
+        names[info.Base] = true
+    }
+    return names
+}
+
+// printSharingReport prints the sharing report as text
+func printSharingReport(report sharingReport) {
+    fmt.Printf("Total seed size: %s\n", strutil.SizeToStr(report.TotalSize))
+    fmt.Printf("Bases and content snaps:\n")
+    for _, s := range report.Snaps {
+        fmt.Printf("  %s (%s): %s, %.1f%% of the seed, used by %d apps", s.Name, s.Role, strutil.SizeToStr(s.Size), s.Share*100, len(s.Apps))
+        if len(s.Apps) > 0 {
+            fmt.Printf(": %s", strings.Join(s.Apps, ", "))
+        }
+        fmt.Printf("\n")
+    }
+
+    fmt.Printf("Channels that would share platform snaps:\n")
+    if len(report.Alternatives) == 0 {
+        fmt.Printf("  (none)\n")
+    }
+    for _, a := range report.Alternatives {
+        fmt.Printf("  %s from %s uses %s instead of %s, shared with %s\n", a.App, a.Channel, a.Uses, a.Replaces, strings.Join(a.SharedBy, ", "))
+    }
+}
+
+// writeSharingReportJSON prints the sharing report as JSON
+func writeSharingReportJSON(report sharingReport) error {
+    content, err := json.MarshalIndent(report, "", "  ")
+    if err != nil {
+        return fmt.Errorf("failed to encode sharing report: %w", err)
+    }
+    return writeOutput("-", append(content, '\n'))
+}
@@ -0,0 +1,302 @@
+// Copyright (C) 2024 Simon Quigley <tsimonq2@ubuntu.com>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 3
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net"
+    "os"
+    "sync"
+    "time"
+
+    "golang.org/x/sys/unix"
+)
+
+const (
+    // socketWriteTimeout is how long a client may take to accept a line before it is dropped
+    socketWriteTimeout = time.Second
+    // socketQueueLength is how many lines a client may fall behind before it is dropped
+    socketQueueLength = 256
+    // socketFlushTimeout is how long the last lines may take to reach the clients once the run is over
+    socketFlushTimeout = 2 * time.Second
+    // fifoPollInterval is how often a full FIFO is checked for room
+    fifoPollInterval = 10 * time.Millisecond
+)
+
+// errFIFOFull is a line that did not fit into the FIFO in time
+var errFIFOFull = errors.New("FIFO is full")
+
+// SocketProgressReporter sends progress events as JSON lines to every client of a Unix socket,
+// or to the reader of a FIFO. Clients connecting late first get the last known state.
+// Every client has its own queue written by its own goroutine, so a slow client never holds up the run.
+type SocketProgressReporter struct {
+    mu       sync.Mutex
+    path     string
+    listener net.Listener
+    fifo     *progressClient
+    clients  []*progressClient
+    closed   bool
+    writers  sync.WaitGroup
+
+    // The last known state, replayed to new clients
+    lastPhase    *progressEvent
+    lastProgress *progressEvent
+    lastDownload *progressEvent
+}
+
+// progressClient is a socket client or the FIFO, with the lines still to be written to it
+type progressClient struct {
+    conn  net.Conn
+    file  *os.File
+    lines chan []byte
+}
+
+// NewSocketProgressReporter listens on a Unix socket at path. If path is an existing FIFO,
+// events are written to it instead.
+func NewSocketProgressReporter(path string) (*SocketProgressReporter, error) {
+    reporter := &SocketProgressReporter{path: path}
+
+    if fi, err := os.Stat(path); err == nil {
+        switch {
+        case fi.Mode()&os.ModeNamedPipe != 0:
+            // Non-blocking, so a missing or slow reader never holds up the run
+            fifo, err := os.OpenFile(path, os.O_RDWR|unix.O_NONBLOCK, 0)
+            if err != nil {
+                return nil, fmt.Errorf("failed to open FIFO %s: %w", path, err)
+            }
+            reporter.fifo = reporter.addClient(&progressClient{file: fifo})
+            return reporter, nil
+        case fi.Mode()&os.ModeSocket != 0:
+            // Only a socket nothing answers on is left behind by an earlier run
+            if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+                conn.Close()
+                return nil, fmt.Errorf("%s is in use by another process", path)
+            }
+            if err := os.Remove(path); err != nil {
+                return nil, fmt.Errorf("failed to remove stale socket %s: %w", path, err)
+            }
+        default:
+            return nil, fmt.Errorf("%s exists and is neither a socket nor a FIFO", path)
+        }
+    }
+
+    listener, err := net.Listen("unix", path)
+    if err != nil {
+        return nil, fmt.Errorf("failed to listen on %s: %w", path, err)
+    }
+    reporter.listener = listener
+    go reporter.acceptClients()
+    return reporter, nil
+}
+
+// addClient starts the goroutine writing the lines queued for a client
+func (s *SocketProgressReporter) addClient(client *progressClient) *progressClient {
+    client.lines = make(chan []byte, socketQueueLength)
+    s.writers.Add(1)
+    go s.writeLines(client)
+    return client
+}
+
+// acceptClients adds every new client, replaying the last known state to it first
+func (s *SocketProgressReporter) acceptClients() {
+    for {
+        conn, err := s.listener.Accept()
+        if err != nil {
+            return
+        }
+
+        s.mu.Lock()
+        if s.closed {
+            s.mu.Unlock()
+            conn.Close()
+            return
+        }
+        client := s.addClient(&progressClient{conn: conn})
+        for _, event := range []*progressEvent{s.lastPhase, s.lastProgress, s.lastDownload} {
+            if event != nil {
+                client.lines <- eventLine(*event)
+            }
+        }
+        s.clients = append(s.clients, client)
+        verboseLog("Progress client connected to %s", s.path)
+        s.mu.Unlock()
+    }
+}
+
+func (s *SocketProgressReporter) Event(event progressEvent) {
+    s.mu.Lock()
+    if s.closed {
+        s.mu.Unlock()
+        return
+    }
+    if event.Time.IsZero() {
+        event.Time = time.Now()
+    }
+
+    switch event.Type {
+    case eventPhaseStart, eventPhaseEnd:
+        s.lastPhase = &event
+    case eventProgress:
+        s.lastProgress = &event
+    case eventDownload:
+        s.lastDownload = &event
+    }
+
+    line := eventLine(event)
+    if s.fifo != nil {
+        select {
+        case s.fifo.lines <- line:
+        default:
+            // Nobody has been reading for a while, the event is dropped
+        }
+    }
+    clients := s.clients[:0]
+    for _, client := range s.clients {
+        select {
+        case client.lines <- line:
+            clients = append(clients, client)
+        default:
+            verboseLog("Dropping progress client of %s, it fell behind", s.path)
+            close(client.lines)
+            client.conn.Close()
+        }
+    }
+    s.clients = clients
+
+    // The summary is the last event, after it everyone is let go
+    if event.Type != eventSummary {
+        s.mu.Unlock()
+        return
+    }
+    s.closed = true
+    for _, client := range s.clients {
+        close(client.lines)
+    }
+    s.clients = nil
+    if s.fifo != nil {
+        close(s.fifo.lines)
+    }
+    if s.listener != nil {
+        s.listener.Close()
+        os.Remove(s.path)
+    }
+    s.mu.Unlock()
+    s.flush()
+}
+
+// flush waits a little for the queued lines to reach the clients
+func (s *SocketProgressReporter) flush() {
+    done := make(chan struct{})
+    go func() {
+        s.writers.Wait()
+        close(done)
+    }()
+    select {
+    case <-done:
+    case <-time.After(socketFlushTimeout):
+        verboseLog("Gave up sending the last progress events to %s", s.path)
+    }
+}
+
+// writeLines writes the queued lines to a client until the queue is closed. A socket client that
+// cannot take a line is dropped, the FIFO only loses the line since its reader may come later.
+func (s *SocketProgressReporter) writeLines(client *progressClient) {
+    defer s.writers.Done()
+    for line := range client.lines {
+        if client.file != nil {
+            if err := writeFIFOLine(client.file, line); err != nil {
+                verboseLog("Dropping progress event for %s: %v", s.path, err)
+            }
+            continue
+        }
+        client.conn.SetWriteDeadline(time.Now().Add(socketWriteTimeout))
+        if _, err := client.conn.Write(line); err != nil {
+            verboseLog("Dropping progress client of %s: %v", s.path, err)
+            s.dropClient(client)
+            break
+        }
+    }
+    if client.file != nil {
+        client.file.Close()
+    } else {
+        client.conn.Close()
+    }
+}
+
+// dropClient stops queueing lines for a client that went away
+func (s *SocketProgressReporter) dropClient(client *progressClient) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for i, other := range s.clients {
+        if other == client {
+            s.clients = append(s.clients[:i], s.clients[i+1:]...)
+            close(client.lines)
+            return
+        }
+    }
+}
+
+// writeFIFOLine writes a line to the FIFO in a single piece. Writes to a pipe larger than PIPE_BUF
+// may be split, so the line is only written once the pipe has room for all of it.
+func writeFIFOLine(fifo *os.File, line []byte) error {
+    deadline := time.Now().Add(socketWriteTimeout)
+    for {
+        free, err := fifoRoom(fifo)
+        if err != nil {
+            return err
+        }
+        if free >= len(line) {
+            _, err := fifo.Write(line)
+            return err
+        }
+        if time.Now().After(deadline) {
+            return errFIFOFull
+        }
+        time.Sleep(fifoPollInterval)
+    }
+}
+
+// fifoRoom returns how many bytes can be written to the FIFO without blocking
+func fifoRoom(fifo *os.File) (int, error) {
+    raw, err := fifo.SyscallConn()
+    if err != nil {
+        return 0, err
+    }
+    var size, queued int
+    var ioctlErr error
+    err = raw.Control(func(fd uintptr) {
+        if size, ioctlErr = unix.FcntlInt(fd, unix.F_GETPIPE_SZ, 0); ioctlErr != nil {
+            return
+        }
+        // TIOCINQ is FIONREAD, the number of bytes waiting in the pipe
+        queued, ioctlErr = unix.IoctlGetInt(int(fd), unix.TIOCINQ)
+    })
+    if err != nil {
+        return 0, err
+    }
+    if ioctlErr != nil {
+        return 0, ioctlErr
+    }
+    return size - queued, nil
+}
+
+// eventLine encodes an event as a line of JSON
+func eventLine(event progressEvent) []byte {
+    content, err := json.Marshal(event)
+    if err != nil {
+        return nil
+    }
+    return append(content, '\n')
+}
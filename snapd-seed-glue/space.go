@@ -0,0 +1,162 @@
+// Copyright (C) 2024 Simon Quigley <tsimonq2@ubuntu.com>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 3
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+package main
+
+import (
+    "fmt"
+    "io/fs"
+    "os"
+    "path/filepath"
+    "strings"
+
+    "github.com/snapcore/snapd/strutil"
+    "golang.org/x/sys/unix"
+)
+
+// diskSpaceMargin is kept free on top of the snaps, for assertions, seed.yaml and filesystem overhead
+const diskSpaceMargin = 16 * 1024 * 1024
+
+// testAvailableSpace replaces the free space found on the filesystem, so tests can run out of it.
+// Only test builds set it, with -ldflags "-X main.testAvailableSpace=1M".
+var testAvailableSpace string
+
+// diskSpaceNeeds is the peak disk usage of downloading the snaps of a run
+type diskSpaceNeeds struct {
+    // Snaps is the size of the new snap files, downloaded, reconstructed from a delta or copied
+    Snaps int64
+    // Deltas is the size of the delta files, which stay next to the old and new snaps until cleanup
+    Deltas int64
+    // Staging is the size of the files copied into the working directory, everything but the snaps
+    Staging int64
+    // Previous is the size of the replaced and removed snaps that the previous generation takes up
+    Previous int64
+}
+
+// Total is the peak number of bytes the run adds to the filesystem
+func (n diskSpaceNeeds) Total() int64 {
+    return n.Snaps + n.Deltas + n.Staging + n.Previous + diskSpaceMargin
+}
+
+// estimateDiskSpace works out the peak disk usage of processing the given snaps into seedDir.
+// Nothing is removed before cleanup, so all new files add up. The working directory only links to
+// the existing snaps, but copies the rest of the seed. Replaced and removed snaps move into the
+// previous generation unless --discard-previous is given, which takes no space unless the seed is
+// on overlayfs: moving a file of the lower layer copies it up.
+func estimateDiskSpace(snapsToProcess []SnapDetails, seedDir string) diskSpaceNeeds {
+    var needs diskSpaceNeeds
+    snapsDir := filepath.Join(seedDir, "snaps")
+    for _, details := range snapsToProcess {
+        if details.LocalPath != "" {
+            // Local snaps kept from the seed are already there
+            if filepath.Dir(details.LocalPath) == snapsDir {
+                continue
+            }
+            if fi, err := os.Stat(details.LocalPath); err == nil {
+                needs.Snaps += fi.Size()
+            }
+            continue
+        }
+        if details.Result == nil || details.Result.Info == nil {
+            continue
+        }
+        needs.Snaps += details.Result.Info.Size
+        // A delta is applied to produce the full snap, with a full download as fallback
+        if len(details.Result.Deltas) > 0 && details.CurrentSnap != nil {
+            needs.Deltas += int64(snapSizeMap[details.Result.Info.SuggestedName])
+        }
+    }
+
+    filepath.WalkDir(seedDir, func(path string, entry fs.DirEntry, err error) error {
+        if err != nil || entry.IsDir() || strings.HasSuffix(path, ".snap") || strings.HasSuffix(path, ".partial") {
+            return nil
+        }
+        if info, err := entry.Info(); err == nil && info.Mode().IsRegular() {
+            needs.Staging += info.Size()
+        }
+        return nil
+    })
+
+    if !discardPrevious && onOverlayfs(seedDir) {
+        leaving := make(map[string]bool)
+        for name := range removalReasons {
+            leaving[name] = true
+        }
+        for _, details := range snapsToProcess {
+            if details.CurrentSnap != nil {
+                leaving[details.CurrentSnap.InstanceName] = true
+            }
+        }
+        for name := range leaving {
+            paths, _ := filepath.Glob(filepath.Join(snapsDir, name+"_*.snap"))
+            for _, path := range paths {
+                if fi, err := os.Stat(path); err == nil {
+                    needs.Previous += fi.Size()
+                }
+            }
+        }
+    }
+    return needs
+}
+
+// onOverlayfs reports whether path is on an overlay filesystem
+func onOverlayfs(path string) bool {
+    var stat unix.Statfs_t
+    if err := unix.Statfs(path, &stat); err != nil {
+        return false
+    }
+    return stat.Type == unix.OVERLAYFS_SUPER_MAGIC
+}
+
+// availableSpace returns the space of the filesystem holding path that is free for unprivileged users
+func availableSpace(path string) (int64, error) {
+    if testAvailableSpace != "" {
+        return parseSize(testAvailableSpace)
+    }
+    var stat unix.Statfs_t
+    if err := unix.Statfs(path, &stat); err != nil {
+        return 0, err
+    }
+    return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
+// checkDiskSpace fails the run before the seed is staged if the filesystem holding seedDir
+// cannot take the peak usage of processing the given snaps
+func checkDiskSpace(snapsToProcess []SnapDetails, seedDir string) {
+    needs := estimateDiskSpace(snapsToProcess, seedDir)
+
+    // The working directory is created next to a seed that does not exist yet
+    spaceDir := seedDir
+    if _, err := os.Stat(spaceDir); os.IsNotExist(err) {
+        spaceDir = filepath.Dir(seedDir)
+    }
+    available, err := availableSpace(spaceDir)
+    if err != nil {
+        verboseLog("Cannot check free space in %s: %v", spaceDir, err)
+        return
+    }
+
+    verboseLog("Disk space needed in %s: %s for snaps, %s for deltas, %s for staging, %s for the previous generation, %s available",
+        spaceDir, strutil.SizeToStr(needs.Snaps), strutil.SizeToStr(needs.Deltas), strutil.SizeToStr(needs.Staging),
+        strutil.SizeToStr(needs.Previous), strutil.SizeToStr(available))
+    if needs.Total() > available {
+        failf(errKindDiskFull, "Not enough disk space in %s: %s", spaceDir, describeSpaceShortage(needs, available))
+    }
+}
+
+// describeSpaceShortage explains how much space is missing
+func describeSpaceShortage(needs diskSpaceNeeds, available int64) string {
+    return fmt.Sprintf("need %s (%s of snaps, %s of deltas, %s of staged files and %s for the previous generation), but only %s is available, %s short",
+        strutil.SizeToStr(needs.Total()), strutil.SizeToStr(needs.Snaps), strutil.SizeToStr(needs.Deltas),
+        strutil.SizeToStr(needs.Staging), strutil.SizeToStr(needs.Previous),
+        strutil.SizeToStr(available), strutil.SizeToStr(needs.Total()-available))
+}
@@ -0,0 +1,153 @@
+// Copyright (C) 2024 Simon Quigley <tsimonq2@ubuntu.com>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 3
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "io"
+    "sort"
+    "sync"
+    "time"
+
+    "github.com/snapcore/snapd/snap"
+    "github.com/snapcore/snapd/strutil"
+)
+
+// Formats of the summary table
+const (
+    summaryFormatText = "text"
+    summaryFormatJSON = "json"
+)
+
+// snapStat is what a run did to a single snap of the seed
+type snapStat struct {
+    Name        string `json:"name"`
+    OldRevision string `json:"old-revision,omitempty"`
+    NewRevision string `json:"new-revision"`
+    Method      string `json:"method"`
+    // Downloaded counts every byte fetched for the snap, including failed delta attempts
+    Downloaded int64 `json:"downloaded"`
+    // Saved is the size of the full snap less the size of the delta that replaced it
+    Saved   int64   `json:"saved"`
+    Elapsed float64 `json:"elapsed"`
+}
+
+var (
+    statsMu   sync.Mutex
+    snapStats = make(map[string]*snapStat)
+)
+
+// statFor returns the statistics of a snap, creating them on first use. The caller holds statsMu.
+func statFor(snapName string) *snapStat {
+    stat, ok := snapStats[snapName]
+    if !ok {
+        stat = &snapStat{Name: snapName}
+        snapStats[snapName] = stat
+    }
+    return stat
+}
+
+// recordOldRevision notes the revision a snap had in the seed before the run
+func recordOldRevision(snapName string, revision snap.Revision) {
+    statsMu.Lock()
+    defer statsMu.Unlock()
+    statFor(snapName).OldRevision = revision.String()
+}
+
+// recordSnapDownload adds downloaded bytes to a snap
+func recordSnapDownload(snapName string, bytes float64) {
+    if bytes <= 0 {
+        return
+    }
+    statsMu.Lock()
+    defer statsMu.Unlock()
+    statFor(snapName).Downloaded += int64(bytes)
+}
+
+// recordSnapMethod notes how a snap got into the seed, and the bytes a delta saved
+func recordSnapMethod(snapName, method string, saved int64) {
+    statsMu.Lock()
+    defer statsMu.Unlock()
+    stat := statFor(snapName)
+    stat.Method = method
+    stat.Saved = saved
+}
+
+// recordSnapElapsed notes how long processing a snap took
+func recordSnapElapsed(snapName string, elapsed time.Duration) {
+    statsMu.Lock()
+    defer statsMu.Unlock()
+    statFor(snapName).Elapsed = elapsed.Seconds()
+}
+
+// buildSnapStats returns the statistics of every snap of the new seed, sorted by name.
+// Snaps the run did not touch are kept.
+func buildSnapStats() []snapStat {
+    statsMu.Lock()
+    defer statsMu.Unlock()
+
+    stats := []snapStat{}
+    kept, _ := splitRequiredSnaps()
+    for _, current := range kept {
+        stat := *statFor(current.InstanceName)
+        stat.NewRevision = current.Revision.String()
+        if stat.Method == "" {
+            stat.Method = methodKept
+        }
+        stats = append(stats, stat)
+    }
+    sort.Slice(stats, func(i, j int) bool {
+        return stats[i].Name < stats[j].Name
+    })
+    return stats
+}
+
+// printSnapStats prints the statistics as a table
+func printSnapStats(w io.Writer, stats []snapStat) {
+    var downloaded, saved int64
+    fmt.Fprintf(w, "%-30s %10s %10s %-6s %10s %10s %8s\n", "Snap", "Old", "New", "Method", "Downloaded", "Saved", "Time")
+    for _, stat := range stats {
+        oldRevision := stat.OldRevision
+        if oldRevision == "" {
+            oldRevision = "-"
+        }
+        fmt.Fprintf(w, "%-30s %10s %10s %-6s %10s %10s %8s\n", stat.Name, oldRevision, stat.NewRevision, stat.Method,
+            strutil.SizeToStr(stat.Downloaded), strutil.SizeToStr(stat.Saved), formatDuration(stat.Elapsed))
+        downloaded += stat.Downloaded
+        saved += stat.Saved
+    }
+    fmt.Fprintf(w, "%-30s %10s %10s %-6s %10s %10s\n", "total", "", "", "", strutil.SizeToStr(downloaded), strutil.SizeToStr(saved))
+}
+
+// writeSnapStatsJSON prints the statistics as JSON
+func writeSnapStatsJSON(w io.Writer, stats []snapStat) error {
+    content, err := json.MarshalIndent(stats, "", "  ")
+    if err != nil {
+        return fmt.Errorf("failed to encode snap statistics: %w", err)
+    }
+    _, err = fmt.Fprintf(w, "%s\n", content)
+    return err
+}
+
+// reportSnapStats prints the statistics of the run in the format asked for with --summary
+func reportSnapStats() {
+    switch summaryFormat {
+    case summaryFormatText:
+        printSnapStats(progressOutput, buildSnapStats())
+    case summaryFormatJSON:
+        if err := writeSnapStatsJSON(progressOutput, buildSnapStats()); err != nil {
+            warnf("%v", err)
+        }
+    }
+}
@@ -0,0 +1,254 @@
+// Copyright (C) 2024 Simon Quigley <tsimonq2@ubuntu.com>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 3
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+package main
+
+import (
+    "fmt"
+    "io"
+    "os"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/snapcore/snapd/strutil"
+    "golang.org/x/sys/unix"
+)
+
+// Layout of the live display
+const (
+    terminalRedrawInterval = 100 * time.Millisecond
+    terminalBarWidth       = 30
+    terminalDefaultWidth   = 80
+)
+
+// isTerminal tells whether w is a terminal that can show the live display
+func isTerminal(w io.Writer) bool {
+    f, ok := w.(*os.File)
+    if !ok || os.Getenv("TERM") == "dumb" {
+        return false
+    }
+    _, err := unix.IoctlGetTermios(int(f.Fd()), unix.TCGETS)
+    return err == nil
+}
+
+// terminalDownload is a download shown with its own bar
+type terminalDownload struct {
+    snap   string
+    method string
+    bytes  int64
+    total  int64
+    rate   float64
+    eta    float64
+}
+
+// TerminalProgressReporter redraws a live display of the current phase, the overall progress
+// and a bar for every active download. Other output is printed above it.
+type TerminalProgressReporter struct {
+    mu        sync.Mutex
+    out       *os.File
+    phase     string
+    percent   int
+    status    string
+    downloads []*terminalDownload
+    // lines is the number of lines drawn last, which the next redraw overwrites
+    lines    int
+    lastDraw time.Time
+    done     bool
+}
+
+// NewTerminalProgressReporter creates a live display on the terminal out
+func NewTerminalProgressReporter(out *os.File) *TerminalProgressReporter {
+    return &TerminalProgressReporter{out: out}
+}
+
+func (t *TerminalProgressReporter) Report(percentage int, status string) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    t.setPercent(percentage)
+    // New messages show right away, the rate in download messages changes a few times a second at most
+    changed := status != t.status
+    t.status = status
+    t.render(changed)
+}
+
+func (t *TerminalProgressReporter) Event(event progressEvent) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    if t.done {
+        return
+    }
+    t.setPercent(event.Percent)
+
+    switch event.Type {
+    case eventPhaseStart:
+        t.phase = event.Phase
+        t.render(true)
+    case eventPhaseEnd:
+        if event.Message != "" {
+            t.status = event.Message
+        }
+        t.downloads = nil
+        t.render(true)
+    case eventProgress:
+        changed := event.Message != t.status
+        t.status = event.Message
+        t.render(changed)
+    case eventNotification:
+        t.status = event.Snap + ": " + event.Message
+        t.render(false)
+    case eventDownload:
+        t.updateDownload(event)
+    case eventSummary:
+        if event.Result == resultSuccess {
+            t.percent = 100
+        }
+        t.phase = ""
+        t.status = event.Message
+        t.downloads = nil
+        t.render(true)
+        // The display stays on screen, later output goes below it
+        t.lines = 0
+        t.done = true
+    }
+}
+
+// setPercent moves the overall progress forward. The caller holds t.mu.
+func (t *TerminalProgressReporter) setPercent(percentage int) {
+    if percentage > t.percent {
+        t.percent = percentage
+    }
+}
+
+// updateDownload updates the bar of a download, dropping it once it is complete. The caller holds t.mu.
+func (t *TerminalProgressReporter) updateDownload(event progressEvent) {
+    for i, download := range t.downloads {
+        if download.snap != event.Snap {
+            continue
+        }
+        if event.Total > 0 && event.Bytes >= event.Total {
+            t.downloads = append(t.downloads[:i], t.downloads[i+1:]...)
+            t.render(true)
+            return
+        }
+        download.method, download.bytes, download.total = event.Method, event.Bytes, event.Total
+        download.rate, download.eta = event.Rate, event.ETA
+        t.render(false)
+        return
+    }
+    if event.Total > 0 && event.Bytes >= event.Total {
+        return
+    }
+    t.downloads = append(t.downloads, &terminalDownload{
+        snap:   event.Snap,
+        method: event.Method,
+        bytes:  event.Bytes,
+        total:  event.Total,
+        rate:   event.Rate,
+        eta:    event.ETA,
+    })
+    t.render(true)
+}
+
+// render redraws the display, at most every terminalRedrawInterval unless force is set. The caller holds t.mu.
+func (t *TerminalProgressReporter) render(force bool) {
+    if t.done || (!force && time.Since(t.lastDraw) < terminalRedrawInterval) {
+        return
+    }
+    t.lastDraw = time.Now()
+
+    width := terminalDefaultWidth
+    if size, err := unix.IoctlGetWinsize(int(t.out.Fd()), unix.TIOCGWINSZ); err == nil && size.Col > 0 {
+        width = int(size.Col)
+    }
+
+    var lines []string
+    if t.phase != "" {
+        lines = append(lines, G(t.phase))
+    }
+    lines = append(lines, fmt.Sprintf("%s %3d%%  %s", progressBar(float64(t.percent)/100), t.percent, t.status))
+    for _, download := range t.downloads {
+        fraction := 0.0
+        if download.total > 0 {
+            fraction = float64(download.bytes) / float64(download.total)
+        }
+        line := fmt.Sprintf("  %s %3d%%  %s (%s) %s/%s", progressBar(fraction), int(fraction*100),
+            download.snap, download.method, strutil.SizeToStr(download.bytes), strutil.SizeToStr(download.total))
+        if download.rate > 0 {
+            line += "  " + fmt.Sprintf(G("%s/s, %s left"), strutil.SizeToStr(int64(download.rate)), formatDuration(download.eta))
+        }
+        lines = append(lines, line)
+    }
+
+    var b strings.Builder
+    t.clearTo(&b)
+    for _, line := range lines {
+        b.WriteString(truncateLine(line, width-1))
+        b.WriteString("\n")
+    }
+    t.out.WriteString(b.String())
+    t.lines = len(lines)
+}
+
+// clearTo writes the escape sequences moving back over the display and clearing it. The caller holds t.mu.
+func (t *TerminalProgressReporter) clearTo(b *strings.Builder) {
+    if t.lines > 0 {
+        fmt.Fprintf(b, "\r\x1b[%dA", t.lines)
+    }
+    b.WriteString("\x1b[J")
+}
+
+// passthrough returns a writer printing to w above the display, for log messages and reports
+func (t *TerminalProgressReporter) passthrough(w io.Writer) io.Writer {
+    return &terminalPassthrough{terminal: t, w: w}
+}
+
+// terminalPassthrough clears the display, writes through and redraws the display below the output
+type terminalPassthrough struct {
+    terminal *TerminalProgressReporter
+    w        io.Writer
+}
+
+func (p *terminalPassthrough) Write(data []byte) (int, error) {
+    t := p.terminal
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    if t.lines > 0 {
+        var b strings.Builder
+        t.clearTo(&b)
+        t.out.WriteString(b.String())
+        t.lines = 0
+    }
+    n, err := p.w.Write(data)
+    t.render(true)
+    return n, err
+}
+
+// progressBar draws a bar of terminalBarWidth characters filled to fraction
+func progressBar(fraction float64) string {
+    if fraction < 0 {
+        fraction = 0
+    } else if fraction > 1 {
+        fraction = 1
+    }
+    filled := int(fraction * terminalBarWidth)
+    return "[" + strings.Repeat("#", filled) + strings.Repeat("-", terminalBarWidth-filled) + "]"
+}
+
+// truncateLine cuts a line to width characters, so it never wraps and throws off the redraw
+func truncateLine(line string, width int) string {
+    runes := []rune(line)
+    if width <= 0 || len(runes) <= width {
+        return line
+    }
+    return string(runes[:width])
+}
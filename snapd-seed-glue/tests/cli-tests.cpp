@@ -10,7 +10,9 @@
 // MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
 // GNU General Public License for more details.
 
+#include <fstream>
 #include <iostream>
+#include <sstream>
 #include <string>
 #include <vector>
 #include <cstdlib>
@@ -61,15 +63,398 @@ void run_snapd_seed_glue(const std::vector<std::string>& args) {
     confirm_success();
 }
 
+bool seed_yaml_contains(const std::string& needle, const std::string& seed = "hello_test") {
+    std::ifstream seed_yaml(seed + "/seed.yaml");
+    std::stringstream contents;
+    contents << seed_yaml.rdbuf();
+    return contents.str().find(needle) != std::string::npos;
+}
+
+void rollback_seed() {
+    auto [output, exit_code] = execute_command("snapd-seed-glue/snapd-seed-glue --verbose --seed hello_test --rollback");
+    if (exit_code != 0 || output.find("Restored the previous seed") == std::string::npos) {
+        exit(1);
+    }
+}
+
 int main() {
     std::cout << "[snapd-seed-glue autopkgtest] Testing snapd-seed-glue with hello...\n";
     run_snapd_seed_glue({"hello"});
 
+    std::cout << "[snapd-seed-glue autopkgtest] Build a separate seed through a saved plan...\n";
+    {
+        auto [output, exit_code] = execute_command("snapd-seed-glue/snapd-seed-glue plan --seed plan_test -o plan_test_plan.json hello htop");
+        if (exit_code != 0) {
+            exit(1);
+        }
+    }
+    {
+        auto [output, exit_code] = execute_command("snapd-seed-glue/snapd-seed-glue apply --verbose --seed plan_test --plan plan_test_plan.json");
+        if (exit_code != 0 || output.find("Cleanup and validation completed") == std::string::npos
+            || !seed_yaml_contains("name: hello", "plan_test") || !seed_yaml_contains("name: htop", "plan_test")) {
+            exit(1);
+        }
+    }
+
+    std::cout << "[snapd-seed-glue autopkgtest] Confirm that a plan is refused once the seed changed...\n";
+    {
+        auto [output, exit_code] = execute_command("snapd-seed-glue/snapd-seed-glue apply --seed plan_test --plan plan_test_plan.json");
+        if (exit_code == 0 || output.find("has changed since the plan was made") == std::string::npos) {
+            exit(1);
+        }
+    }
+
     std::cout << "[snapd-seed-glue autopkgtest] Add htop to the same seed...\n";
     run_snapd_seed_glue({"hello", "htop"});
 
+    std::cout << "[snapd-seed-glue autopkgtest] Plan replacing htop with btop without touching the seed...\n";
+    {
+        auto [output, exit_code] = execute_command("snapd-seed-glue/snapd-seed-glue --seed hello_test --dry-run hello btop");
+        if (exit_code != 0 || output.find("+ btop") == std::string::npos || output.find("- htop") == std::string::npos) {
+            exit(1);
+        }
+        if (!seed_yaml_contains("name: htop") || seed_yaml_contains("name: btop")) {
+            exit(1);
+        }
+    }
+
     std::cout << "[snapd-seed-glue autopkgtest] Remove htop and replace it with btop...\n";
     run_snapd_seed_glue({"hello", "btop"});
+    if (!seed_yaml_contains("name: hello") || seed_yaml_contains("name: htop") || !seed_yaml_contains("name: btop")) {
+        exit(1);
+    }
+
+    std::cout << "[snapd-seed-glue autopkgtest] Roll back to the seed with htop, then forward again...\n";
+    rollback_seed();
+    if (!seed_yaml_contains("name: htop") || seed_yaml_contains("name: btop")) {
+        exit(1);
+    }
+    rollback_seed();
+    if (seed_yaml_contains("name: htop") || !seed_yaml_contains("name: btop")) {
+        exit(1);
+    }
+
+    std::cout << "[snapd-seed-glue autopkgtest] Replace btop with htop through --remove, keeping hello...\n";
+    run_snapd_seed_glue({"--remove", "btop", "htop"});
+    if (!seed_yaml_contains("name: hello") || !seed_yaml_contains("name: htop") || seed_yaml_contains("name: btop")) {
+        exit(1);
+    }
+    {
+        auto [output, exit_code] = execute_command("grep -qx hello hello_test/requested-snaps && grep -qx htop hello_test/requested-snaps");
+        if (exit_code != 0) {
+            exit(1);
+        }
+    }
+
+    std::cout << "[snapd-seed-glue autopkgtest] Add btop while keeping the rest of the seed...\n";
+    run_snapd_seed_glue({"--incremental", "btop"});
+    if (!seed_yaml_contains("name: hello") || !seed_yaml_contains("name: htop") || !seed_yaml_contains("name: btop")) {
+        exit(1);
+    }
+
+    std::cout << "[snapd-seed-glue autopkgtest] Remove btop explicitly...\n";
+    {
+        auto [output, exit_code] = execute_command("snapd-seed-glue/snapd-seed-glue --verbose --seed hello_test --remove btop");
+        if (exit_code != 0 || output.find("Removing btop from the seed: removed with --remove") == std::string::npos) {
+            exit(1);
+        }
+        if (!seed_yaml_contains("name: hello") || !seed_yaml_contains("name: htop") || seed_yaml_contains("name: btop")) {
+            exit(1);
+        }
+    }
+
+    std::cout << "[snapd-seed-glue autopkgtest] Seed a locally built snap and keep it across runs...\n";
+    {
+        auto [output, exit_code] = execute_command("rm -rf local_snap local_snap_out && mkdir -p local_snap/meta local_snap_out && "
+            "printf 'name: seed-glue-local\\nversion: \"1\"\\nsummary: Local test snap\\ndescription: Local test snap\\nbase: bare\\n' > local_snap/meta/snap.yaml && "
+            "snap pack local_snap local_snap_out && "
+            "snapd-seed-glue/snapd-seed-glue --seed hello_test --dry-run --incremental --local-snap local_snap_out/*.snap");
+        if (exit_code != 0 || output.find("local copy of") == std::string::npos || output.find("local copy of 0B") != std::string::npos) {
+            exit(1);
+        }
+    }
+    run_snapd_seed_glue({"--incremental", "--local-snap", "local_snap_out/*.snap"});
+    if (!seed_yaml_contains("name: seed-glue-local") || !seed_yaml_contains("unasserted: true")) {
+        exit(1);
+    }
+    run_snapd_seed_glue({"--incremental"});
+    if (!seed_yaml_contains("name: seed-glue-local") || !seed_yaml_contains("name: htop")) {
+        exit(1);
+    }
+    {
+        auto [output, exit_code] = execute_command("snapd-seed-glue/snapd-seed-glue --seed hello_test --remove seed-glue-local");
+        if (exit_code != 0 || output.find("Removing seed-glue-local from the seed") == std::string::npos || seed_yaml_contains("name: seed-glue-local")) {
+            exit(1);
+        }
+    }
+
+    std::cout << "[snapd-seed-glue autopkgtest] Override the content provider of a snap...\n";
+    {
+        auto [output, exit_code] = execute_command("rm -rf content_snap content_snap_out && mkdir -p content_snap/meta content_snap_out && "
+            "printf 'name: seed-glue-content\\nversion: \"1\"\\nsummary: Content test snap\\ndescription: Content test snap\\nbase: bare\\n"
+            "plugs:\\n  themes:\\n    interface: content\\n    content: gtk-3-themes\\n    target: $SNAP/themes\\n    default-provider: gtk-common-themes\\n' "
+            "> content_snap/meta/snap.yaml && snap pack content_snap content_snap_out && "
+            "snapd-seed-glue/snapd-seed-glue --seed provider_test --local-snap content_snap_out/*.snap "
+            "--provider-override seed-glue-content:gtk-3-themes=btop");
+        if (exit_code != 0 || output.find("Content gtk-3-themes of seed-glue-content is not provided by btop") == std::string::npos) {
+            exit(1);
+        }
+        if (!seed_yaml_contains("name: btop", "provider_test") || seed_yaml_contains("name: gtk-common-themes", "provider_test")) {
+            exit(1);
+        }
+    }
+    {
+        auto [output, exit_code] = execute_command("snapd-seed-glue/snapd-seed-glue --seed provider_test --local-snap content_snap_out/*.snap "
+            "--provider-override '*:gtk-3-themes=htop'");
+        if (exit_code != 0 || !seed_yaml_contains("name: htop", "provider_test") || seed_yaml_contains("name: btop", "provider_test")
+            || seed_yaml_contains("name: gtk-common-themes", "provider_test")) {
+            exit(1);
+        }
+    }
+
+    std::cout << "[snapd-seed-glue autopkgtest] Warn about content left without its excluded provider...\n";
+    {
+        auto [output, exit_code] = execute_command("snapd-seed-glue/snapd-seed-glue --seed provider_test --dry-run --local-snap content_snap_out/*.snap "
+            "--exclude gtk-common-themes");
+        if (exit_code != 0 || output.find("Content gtk-3-themes of seed-glue-content is not provided by any snap in the seed, its provider gtk-common-themes is excluded") == std::string::npos
+            || output.find("+ gtk-common-themes") != std::string::npos) {
+            exit(1);
+        }
+    }
+
+    std::cout << "[snapd-seed-glue autopkgtest] Lint content left without its provider...\n";
+    {
+        auto [output, exit_code] = execute_command("snapd-seed-glue/snapd-seed-glue lint --seed provider_test --exclude gtk-common-themes");
+        if (exit_code != 0 || output.find("its provider gtk-common-themes is excluded") == std::string::npos) {
+            exit(1);
+        }
+    }
+    {
+        auto [output, exit_code] = execute_command("snapd-seed-glue/snapd-seed-glue lint --seed provider_test");
+        if (exit_code != 1 || output.find("error: missing-provider: seed-glue-content") == std::string::npos) {
+            exit(1);
+        }
+    }
+
+    std::cout << "[snapd-seed-glue autopkgtest] Explain why snaps are in the seed...\n";
+    {
+        auto [output, exit_code] = execute_command("snapd-seed-glue/snapd-seed-glue why --seed hello_test snapd");
+        if (exit_code != 0 || output.find("snapd is always seeded") == std::string::npos) {
+            exit(1);
+        }
+    }
+    {
+        auto [output, exit_code] = execute_command("snapd-seed-glue/snapd-seed-glue why --seed hello_test btop");
+        if (exit_code == 0 || output.find("btop is not in the seed") == std::string::npos) {
+            exit(1);
+        }
+    }
+
+    std::cout << "[snapd-seed-glue autopkgtest] Export the dependency graph...\n";
+    {
+        auto [output, exit_code] = execute_command("snapd-seed-glue/snapd-seed-glue graph --seed hello_test --format json -o hello_test_graph.json");
+        std::ifstream graph_file("hello_test_graph.json");
+        std::stringstream graph;
+        graph << graph_file.rdbuf();
+        if (exit_code != 0 || graph.str().find("\"name\": \"htop\"") == std::string::npos || graph.str().find("\"role\": \"snapd\"") == std::string::npos
+            || graph.str().find("\"name\": \"bare\",\n      \"role\": \"base\"") == std::string::npos) {
+            exit(1);
+        }
+    }
+
+    std::cout << "[snapd-seed-glue autopkgtest] Check assumes against the seeded snapd...\n";
+    {
+        auto [output, exit_code] = execute_command("snapd-seed-glue/snapd-seed-glue --seed hello_test --dry-run --strict-assumes hello htop");
+        if (exit_code != 0 || output.find("does not provide") != std::string::npos) {
+            exit(1);
+        }
+    }
+
+    std::cout << "[snapd-seed-glue autopkgtest] Lint the seed...\n";
+    {
+        auto [output, exit_code] = execute_command("snapd-seed-glue/snapd-seed-glue lint --seed hello_test --format json");
+        if (exit_code != 0 || output.find("\"findings\"") == std::string::npos || output.find("missing-base") != std::string::npos) {
+            exit(1);
+        }
+    }
+
+    std::cout << "[snapd-seed-glue autopkgtest] Report how snaps share bases...\n";
+    {
+        auto [output, exit_code] = execute_command("snapd-seed-glue/snapd-seed-glue sharing --seed hello_test");
+        if (exit_code != 0 || output.find("Bases and content snaps:") == std::string::npos) {
+            exit(1);
+        }
+    }
+
+    std::cout << "[snapd-seed-glue autopkgtest] Confirm that a seed over its size budget fails...\n";
+    {
+        auto [output, exit_code] = execute_command("snapd-seed-glue/snapd-seed-glue --seed hello_test --dry-run --max-size 1M hello htop");
+        if (exit_code == 0 || output.find("over its budget of") == std::string::npos) {
+            exit(1);
+        }
+    }
+
+    std::cout << "[snapd-seed-glue autopkgtest] Refuse a classic snap for a model that is not classic...\n";
+    {
+        auto [output, exit_code] = execute_command("mkdir -p core_test/assertions && "
+            "snap known --remote model series=16 brand-id=canonical model=ubuntu-core-22-amd64 > core_test/assertions/model && "
+            "snapd-seed-glue/snapd-seed-glue --seed core_test --dry-run go");
+        if (exit_code != 13 || output.find("it uses classic confinement") == std::string::npos) {
+            exit(1);
+        }
+    }
+
+    std::cout << "[snapd-seed-glue autopkgtest] Confirm that a seed too big for the disk fails before staging...\n";
+    {
+        auto [output, exit_code] = execute_command("snapd-seed-glue/tests/snapd-seed-glue-full-disk --seed hello_test hello htop; "
+            "code=$?; test ! -e hello_test.new && exit $code");
+        if (exit_code != 11 || output.find("Not enough disk space") == std::string::npos) {
+            exit(1);
+        }
+    }
+
+    std::cout << "[snapd-seed-glue autopkgtest] Report progress as JSON lines...\n";
+    {
+        auto [output, exit_code] = execute_command("snapd-seed-glue/snapd-seed-glue --seed hello_test --progress-format jsonl hello htop");
+        if (exit_code != 0 || output.find("\"event\":\"phase-start\"") == std::string::npos || output.find("\"event\":\"resolve\"") == std::string::npos
+            || output.find("\"result\":\"success\"") == std::string::npos) {
+            exit(1);
+        }
+    }
+
+    std::cout << "[snapd-seed-glue autopkgtest] Confirm that progress never goes backwards...\n";
+    {
+        auto [output, exit_code] = execute_command("snapd-seed-glue/snapd-seed-glue --seed hello_test hello htop btop");
+        if (exit_code != 0) {
+            exit(1);
+        }
+        std::istringstream lines(output);
+        std::string line;
+        int last_percentage = 0;
+        while (std::getline(lines, line)) {
+            size_t tab = line.find('\t');
+            if (tab == std::string::npos || tab == 0 || line.find_first_not_of("0123456789") != tab) {
+                continue;
+            }
+            int percentage = std::stoi(line.substr(0, tab));
+            if (percentage < last_percentage) {
+                exit(1);
+            }
+            last_percentage = percentage;
+        }
+    }
+
+    std::cout << "[snapd-seed-glue autopkgtest] Print the per-snap summary...\n";
+    {
+        auto [output, exit_code] = execute_command("snapd-seed-glue/snapd-seed-glue --seed hello_test --summary json hello htop");
+        if (exit_code != 0 || output.find("\"method\": \"kept\"") == std::string::npos || output.find("\"new-revision\"") == std::string::npos) {
+            exit(1);
+        }
+    }
+
+    std::cout << "[snapd-seed-glue autopkgtest] Show the live display on a terminal...\n";
+    {
+        auto [output, exit_code] = execute_command("script -qec 'snapd-seed-glue/snapd-seed-glue --seed hello_test hello htop' /dev/null");
+        if (exit_code != 0 || output.find("\x1b[J") == std::string::npos || output.find("Verifying snaps") == std::string::npos) {
+            exit(1);
+        }
+    }
+
+    std::cout << "[snapd-seed-glue autopkgtest] Keep phase names untranslated in progress events...\n";
+    {
+        auto [output, exit_code] = execute_command("LANG=de_DE.UTF-8 LANGUAGE=de snapd-seed-glue/snapd-seed-glue --seed hello_test --progress-format jsonl hello htop");
+        if (exit_code != 0 || output.find("\"phase\":\"Downloading snaps\"") == std::string::npos) {
+            exit(1);
+        }
+    }
+
+    std::cout << "[snapd-seed-glue autopkgtest] Send progress to a FIFO...\n";
+    {
+        auto [output, exit_code] = execute_command("rm -f hello_test.fifo && mkfifo hello_test.fifo && (cat hello_test.fifo > hello_test_fifo.log &) "
+            "&& snapd-seed-glue/snapd-seed-glue --seed hello_test --progress-socket hello_test.fifo hello htop && sleep 1 && cat hello_test_fifo.log");
+        if (exit_code != 0 || output.find("\"event\":\"summary\"") == std::string::npos) {
+            exit(1);
+        }
+    }
+
+    std::cout << "[snapd-seed-glue autopkgtest] Publish progress on a private D-Bus session bus...\n";
+    {
+        auto [output, exit_code] = execute_command("dbus-run-session -- sh -c '"
+            "dbus-monitor --session \"interface=org.lubuntu.SnapdSeedGlue.Progress\" > hello_test_dbus.log 2>&1 & sleep 1; "
+            "snapd-seed-glue/snapd-seed-glue --seed hello_test --dbus session hello htop && sleep 1 && cat hello_test_dbus.log'");
+        if (exit_code != 0 || output.find("member=PhaseChanged") == std::string::npos || output.find("member=Completed") == std::string::npos) {
+            exit(1);
+        }
+    }
+
+    std::cout << "[snapd-seed-glue autopkgtest] Write an error report for a snap that does not exist...\n";
+    {
+        auto [output, exit_code] = execute_command("snapd-seed-glue/snapd-seed-glue --seed hello_test --error-report hello_test_error.json "
+            "absolutelyridiculouslongnamethatwilldefinitelyneverexist; cat hello_test_error.json");
+        if (output.find("\"id\": \"snap-not-found\"") == std::string::npos || output.find("\"exit-code\": 4") == std::string::npos) {
+            exit(1);
+        }
+    }
+
+    std::cout << "[snapd-seed-glue autopkgtest] Keep the existing seed when the store refuses connections...\n";
+    {
+        auto [output, exit_code] = execute_command("cp hello_test/seed.yaml hello_test_offline.yaml && "
+            "SNAPPY_FORCE_API_URL=http://127.0.0.1:9/ snapd-seed-glue/snapd-seed-glue --seed hello_test --on-offline keep hello htop 2>&1 && "
+            "cmp hello_test/seed.yaml hello_test_offline.yaml");
+        if (exit_code != 0 || output.find("Kept existing seed") == std::string::npos) {
+            exit(1);
+        }
+    }
+
+    std::cout << "[snapd-seed-glue autopkgtest] Fail when the store refuses connections...\n";
+    {
+        auto [output, exit_code] = execute_command("SNAPPY_FORCE_API_URL=http://127.0.0.1:9/ snapd-seed-glue/snapd-seed-glue --seed hello_test --on-offline fail hello htop");
+        if (exit_code != 3) {
+            exit(1);
+        }
+    }
+
+    std::cout << "[snapd-seed-glue autopkgtest] Fail a dry run when the store refuses connections, even with keep...\n";
+    {
+        auto [output, exit_code] = execute_command("SNAPPY_FORCE_API_URL=http://127.0.0.1:9/ snapd-seed-glue/snapd-seed-glue --seed hello_test --dry-run --on-offline keep hello htop");
+        if (exit_code != 3 || output.find("Kept existing seed") != std::string::npos) {
+            exit(1);
+        }
+    }
+
+    std::cout << "[snapd-seed-glue autopkgtest] Refuse to change a seed that is locked...\n";
+    {
+        auto [output, exit_code] = execute_command("flock hello_test.lock sleep 3 & sleep 0.5; "
+            "snapd-seed-glue/snapd-seed-glue --seed hello_test hello htop; code=$?; wait; exit $code");
+        if (exit_code != 12 || output.find("is locked by another snapd-seed-glue process") == std::string::npos) {
+            exit(1);
+        }
+    }
+    {
+        auto [output, exit_code] = execute_command("flock hello_test.lock sleep 3 & sleep 0.5; "
+            "snapd-seed-glue/snapd-seed-glue --seed hello_test --wait --wait-timeout 1s hello htop; code=$?; wait; exit $code");
+        if (exit_code != 12 || output.find("timed out after 1s waiting for the lock") == std::string::npos) {
+            exit(1);
+        }
+    }
+    {
+        // A run that cannot lock the seed must leave the progress socket alone
+        auto [output, exit_code] = execute_command("rm -f hello_test.sock; flock hello_test.lock sleep 3 & sleep 0.5; "
+            "snapd-seed-glue/snapd-seed-glue --seed hello_test --progress-socket hello_test.sock hello htop; code=$?; wait; "
+            "test ! -e hello_test.sock || exit 1; exit $code");
+        if (exit_code != 12) {
+            exit(1);
+        }
+    }
+
+    std::cout << "[snapd-seed-glue autopkgtest] Read a seed that another reader holds...\n";
+    {
+        auto [output, exit_code] = execute_command("flock -s hello_test.lock sleep 3 & sleep 0.5; "
+            "snapd-seed-glue/snapd-seed-glue lint --seed hello_test; code=$?; wait; exit $code");
+        if (exit_code == 12) {
+            exit(1);
+        }
+    }
 
     std::cout << "[snapd-seed-glue autopkgtest] Confirm that non-existent snaps will fail...\n";
     std::string invalid_snap = "absolutelyridiculouslongnamethatwilldefinitelyneverexist";
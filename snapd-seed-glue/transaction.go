@@ -0,0 +1,478 @@
+// Copyright (C) 2024 Simon Quigley <tsimonq2@ubuntu.com>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 3
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+package main
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "io/fs"
+    "io/ioutil"
+    "log"
+    "os"
+    "path/filepath"
+    "strings"
+
+    "golang.org/x/sys/unix"
+)
+
+// seedTransaction stages every change to a seed in a sibling working directory,
+// whose changes only reach the live seed once it has been validated
+type seedTransaction struct {
+    seedDir     string
+    stageDir    string
+    previousDir string
+    // wholeGeneration is set when the working directory holds the complete new seed,
+    // so it can be swapped with the live seed as a directory
+    wholeGeneration bool
+}
+
+// seedStageDir returns the working directory used while a new seed is being built
+func seedStageDir(seedDir string) string {
+    return seedDir + ".new"
+}
+
+// seedPreviousDir returns the directory holding the previous seed generation
+func seedPreviousDir(seedDir string) string {
+    return seedDir + ".old"
+}
+
+// previousManifest lists, inside a previous generation made of the replaced files only,
+// the files that generation did not have
+const previousManifest = ".added"
+
+// beginSeedTransaction creates a fresh working copy of the seed directory.
+// Snaps are never modified in place, so the working copy only links to them and copies everything else.
+// On overlayfs, directories of the lower layer cannot be renamed and hard links copy snaps up, so the
+// working copy links to the live snaps symbolically and only its changed files are swapped in.
+func beginSeedTransaction(seedDir string) (*seedTransaction, error) {
+    seedDir = filepath.Clean(seedDir)
+    tx := &seedTransaction{
+        seedDir:     seedDir,
+        stageDir:    seedStageDir(seedDir),
+        previousDir: seedPreviousDir(seedDir),
+    }
+
+    // A working directory left behind by an interrupted run is of no use
+    if _, err := os.Stat(tx.stageDir); err == nil {
+        verboseLog("Removing stale working directory %s", tx.stageDir)
+    }
+    if err := os.RemoveAll(tx.stageDir); err != nil {
+        return nil, fmt.Errorf("failed to remove stale working directory %s: %w", tx.stageDir, err)
+    }
+
+    if _, err := os.Stat(seedDir); os.IsNotExist(err) {
+        if err := os.MkdirAll(tx.stageDir, 0755); err != nil {
+            return nil, fmt.Errorf("failed to create working directory %s: %w", tx.stageDir, err)
+        }
+        tx.wholeGeneration = true
+        return tx, nil
+    }
+
+    whole, err := stageSeedTree(seedDir, tx.stageDir, !onOverlayfs(seedDir))
+    if err != nil {
+        os.RemoveAll(tx.stageDir)
+        return nil, fmt.Errorf("failed to stage seed %s: %w", seedDir, err)
+    }
+    tx.wholeGeneration = whole
+    verboseLog("Staging seed changes in %s", tx.stageDir)
+    return tx, nil
+}
+
+// stageSeedTree recreates the seed directory tree at stageDir. With hardLink, snap files are hard
+// linked, otherwise they become symbolic links to the live seed. It reports whether every snap
+// was hard linked, so the working copy stands on its own.
+func stageSeedTree(seedDir, stageDir string, hardLink bool) (bool, error) {
+    liveDir, err := filepath.Abs(seedDir)
+    if err != nil {
+        return false, err
+    }
+    whole := hardLink
+    err = filepath.WalkDir(seedDir, func(path string, entry fs.DirEntry, err error) error {
+        if err != nil {
+            return err
+        }
+        relPath, err := filepath.Rel(seedDir, path)
+        if err != nil {
+            return err
+        }
+        target := filepath.Join(stageDir, relPath)
+
+        info, err := entry.Info()
+        if err != nil {
+            return err
+        }
+        switch {
+        case entry.IsDir():
+            return os.MkdirAll(target, info.Mode().Perm())
+        case info.Mode()&fs.ModeSymlink != 0:
+            link, err := os.Readlink(path)
+            if err != nil {
+                return err
+            }
+            return os.Symlink(link, target)
+        case strings.HasSuffix(path, ".partial"):
+            return nil
+        case strings.HasSuffix(path, ".snap"):
+            if whole {
+                if err := os.Link(path, target); err == nil {
+                    return nil
+                }
+                whole = false
+            }
+            return os.Symlink(filepath.Join(liveDir, relPath), target)
+        }
+        if err := copyFile(path, target); err != nil {
+            return err
+        }
+        return os.Chmod(target, info.Mode().Perm())
+    })
+    return whole, err
+}
+
+// Commit swaps the new seed in. A working copy holding the whole generation is exchanged with the
+// live seed in one step. Otherwise the changed files are moved in, seed.yaml last so the live seed
+// never refers to a snap it does not have yet. The replaced seed becomes the previous generation
+// for --rollback, unless keepPrevious is unset.
+func (tx *seedTransaction) Commit(keepPrevious bool) error {
+    if _, err := os.Stat(tx.seedDir); os.IsNotExist(err) {
+        if err := os.Rename(tx.stageDir, tx.seedDir); err != nil {
+            return fmt.Errorf("failed to move new seed into place: %w", err)
+        }
+        verboseLog("Created seed %s", tx.seedDir)
+        return nil
+    }
+
+    if tx.wholeGeneration {
+        err := exchangeDirs(tx.stageDir, tx.seedDir)
+        if err == nil {
+            // After the exchange the working directory holds the replaced seed
+            verboseLog("Swapped new seed into %s", tx.seedDir)
+            return replacePreviousGeneration(tx.previousDir, tx.stageDir, keepPrevious)
+        }
+        if !cannotExchange(err) {
+            return fmt.Errorf("failed to move new seed into place: %w", err)
+        }
+        verboseLog("Cannot swap %s in as a whole (%v), moving the changed files instead", tx.stageDir, err)
+    }
+
+    changed, removed, err := stagedChanges(tx.stageDir, tx.seedDir)
+    if err != nil {
+        return fmt.Errorf("failed to compare staged seed: %w", err)
+    }
+    // The replaced files only take the place of the previous generation once the swap is done
+    nextDir := ""
+    if keepPrevious {
+        nextDir = tx.previousDir + ".next"
+        if err := os.RemoveAll(nextDir); err != nil {
+            return fmt.Errorf("failed to remove stale directory %s: %w", nextDir, err)
+        }
+    }
+    if err := swapInFiles(tx.stageDir, tx.seedDir, nextDir, changed, removed); err != nil {
+        return fmt.Errorf("failed to move new seed into place: %w", err)
+    }
+    if err := os.RemoveAll(tx.stageDir); err != nil {
+        verboseLog("Failed to remove working directory %s: %v", tx.stageDir, err)
+    }
+    verboseLog("Updated seed %s", tx.seedDir)
+    return replacePreviousGeneration(tx.previousDir, nextDir, keepPrevious)
+}
+
+// replacePreviousGeneration makes replacedDir the previous generation with keep, or removes it.
+// A previous generation kept by an earlier run is never dropped without saying so.
+func replacePreviousGeneration(previousDir, replacedDir string, keep bool) error {
+    if _, err := os.Stat(previousDir); err == nil {
+        if keep {
+            log.Printf("Replacing the previous seed generation in %s with the seed just replaced", previousDir)
+        } else {
+            log.Printf("Removing the previous seed generation in %s, --rollback cannot restore it anymore", previousDir)
+        }
+        if err := os.RemoveAll(previousDir); err != nil {
+            return fmt.Errorf("failed to remove previous seed generation %s: %w", previousDir, err)
+        }
+    }
+    if !keep {
+        if replacedDir != "" {
+            if err := os.RemoveAll(replacedDir); err != nil {
+                verboseLog("Failed to remove replaced seed %s: %v", replacedDir, err)
+            }
+        }
+        return nil
+    }
+    if err := os.Rename(replacedDir, previousDir); err != nil {
+        return fmt.Errorf("failed to keep previous seed generation: %w", err)
+    }
+    verboseLog("Previous seed generation kept in %s", previousDir)
+    return nil
+}
+
+// exchangeDirs atomically swaps two directories
+func exchangeDirs(a, b string) error {
+    return unix.Renameat2(unix.AT_FDCWD, a, unix.AT_FDCWD, b, unix.RENAME_EXCHANGE)
+}
+
+// cannotExchange reports whether exchangeDirs failed because the filesystem cannot swap the
+// directories, as overlayfs cannot for directories of its lower layer
+func cannotExchange(err error) bool {
+    return errors.Is(err, unix.EINVAL) || errors.Is(err, unix.ENOSYS) || errors.Is(err, unix.EXDEV)
+}
+
+// stagedChanges compares the working copy with the live seed. It returns the files that were added
+// or replaced, with seed.yaml last, and the files that were removed, as paths relative to the seed.
+func stagedChanges(stageDir, seedDir string) ([]string, []string, error) {
+    liveDir, err := filepath.Abs(seedDir)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    var changed []string
+    changedSeedYaml := false
+    err = filepath.WalkDir(stageDir, func(path string, entry fs.DirEntry, err error) error {
+        if err != nil || entry.IsDir() {
+            return err
+        }
+        relPath, err := filepath.Rel(stageDir, path)
+        if err != nil {
+            return err
+        }
+        same, err := sameSeedFile(path, filepath.Join(seedDir, relPath), filepath.Join(liveDir, relPath))
+        if err != nil || same {
+            return err
+        }
+        if relPath == "seed.yaml" {
+            changedSeedYaml = true
+        } else {
+            changed = append(changed, relPath)
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, nil, err
+    }
+    if changedSeedYaml {
+        changed = append(changed, "seed.yaml")
+    }
+
+    var removed []string
+    err = filepath.WalkDir(seedDir, func(path string, entry fs.DirEntry, err error) error {
+        if err != nil || entry.IsDir() {
+            return err
+        }
+        relPath, err := filepath.Rel(seedDir, path)
+        if err != nil {
+            return err
+        }
+        if _, err := os.Lstat(filepath.Join(stageDir, relPath)); os.IsNotExist(err) {
+            removed = append(removed, relPath)
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, nil, err
+    }
+    return changed, removed, nil
+}
+
+// sameSeedFile reports whether a staged file leaves the live file as it is: either it is a link
+// to the live file made while staging, or it has the same content
+func sameSeedFile(stagePath, livePath, liveAbsPath string) (bool, error) {
+    stageInfo, err := os.Lstat(stagePath)
+    if err != nil {
+        return false, err
+    }
+    liveInfo, err := os.Lstat(livePath)
+    if os.IsNotExist(err) {
+        return false, nil
+    } else if err != nil {
+        return false, err
+    }
+
+    if stageInfo.Mode()&fs.ModeSymlink != 0 {
+        link, err := os.Readlink(stagePath)
+        if err != nil {
+            return false, err
+        }
+        if link == liveAbsPath {
+            return true, nil
+        }
+        if liveInfo.Mode()&fs.ModeSymlink == 0 {
+            return false, nil
+        }
+        liveLink, err := os.Readlink(livePath)
+        return link == liveLink, err
+    }
+    if os.SameFile(stageInfo, liveInfo) {
+        return true, nil
+    }
+    if !liveInfo.Mode().IsRegular() || stageInfo.Size() != liveInfo.Size() || stageInfo.Mode() != liveInfo.Mode() {
+        return false, nil
+    }
+    stageContent, err := ioutil.ReadFile(stagePath)
+    if err != nil {
+        return false, err
+    }
+    liveContent, err := ioutil.ReadFile(livePath)
+    if err != nil {
+        return false, err
+    }
+    return bytes.Equal(stageContent, liveContent), nil
+}
+
+// swapInFiles moves the changed files from fromDir into seedDir and removes the removed ones.
+// Unless previousDir is empty, the files it replaces or removes go there along with a manifest of
+// the files seedDir did not have, so the swap can be undone.
+func swapInFiles(fromDir, seedDir, previousDir string, changed, removed []string) error {
+    var added []string
+    for _, relPath := range changed {
+        livePath := filepath.Join(seedDir, relPath)
+        if _, err := os.Lstat(livePath); os.IsNotExist(err) {
+            added = append(added, relPath)
+        } else if previousDir != "" {
+            if err := moveSeedFile(livePath, filepath.Join(previousDir, relPath), true); err != nil {
+                return err
+            }
+        }
+        if err := moveSeedFile(filepath.Join(fromDir, relPath), livePath, false); err != nil {
+            return err
+        }
+    }
+
+    for _, relPath := range removed {
+        livePath := filepath.Join(seedDir, relPath)
+        if previousDir == "" {
+            if err := os.Remove(livePath); err != nil && !os.IsNotExist(err) {
+                return err
+            }
+            continue
+        }
+        if err := moveSeedFile(livePath, filepath.Join(previousDir, relPath), false); err != nil {
+            return err
+        }
+    }
+
+    if previousDir == "" {
+        return nil
+    }
+    if err := os.MkdirAll(previousDir, 0755); err != nil {
+        return err
+    }
+    manifest := strings.Join(added, "\n")
+    if manifest != "" {
+        manifest += "\n"
+    }
+    return ioutil.WriteFile(filepath.Join(previousDir, previousManifest), []byte(manifest), 0644)
+}
+
+// moveSeedFile renames src to dst, creating the directories dst needs.
+// With keep, src stays in place and dst becomes a hard link to it.
+func moveSeedFile(src, dst string, keep bool) error {
+    if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+        return err
+    }
+    if keep {
+        if err := os.Link(src, dst); err == nil {
+            return nil
+        }
+        return copyFile(src, dst)
+    }
+    return os.Rename(src, dst)
+}
+
+// Abort throws away every staged change
+func (tx *seedTransaction) Abort() {
+    if err := os.RemoveAll(tx.stageDir); err != nil {
+        verboseLog("Failed to remove working directory %s: %v", tx.stageDir, err)
+    }
+}
+
+// rollbackSeed swaps the previous seed generation back in.
+// The replaced seed becomes the previous generation, so a rollback can itself be undone.
+func rollbackSeed(seedDir string) error {
+    seedDir = filepath.Clean(seedDir)
+    previousDir := seedPreviousDir(seedDir)
+    if _, err := os.Stat(previousDir); os.IsNotExist(err) {
+        return fmt.Errorf("no previous seed generation to roll back to in %s", previousDir)
+    }
+    if _, err := os.Stat(seedDir); os.IsNotExist(err) {
+        os.Remove(filepath.Join(previousDir, previousManifest))
+        return os.Rename(previousDir, seedDir)
+    }
+
+    manifest, err := ioutil.ReadFile(filepath.Join(previousDir, previousManifest))
+    if err != nil && !os.IsNotExist(err) {
+        return fmt.Errorf("failed to read previous seed generation: %w", err)
+    }
+    var restored, removed []string
+    if os.IsNotExist(err) {
+        // A whole generation is exchanged with the live seed, or compared with it if it cannot be
+        err := exchangeDirs(previousDir, seedDir)
+        if err == nil {
+            verboseLog("Restored previous seed generation from %s", previousDir)
+            return nil
+        }
+        if !cannotExchange(err) {
+            return fmt.Errorf("failed to restore previous seed generation: %w", err)
+        }
+        restored, removed, err = stagedChanges(previousDir, seedDir)
+        if err != nil {
+            return fmt.Errorf("failed to read previous seed generation: %w", err)
+        }
+    } else {
+        // The files of the previous generation come back, the files it did not have go
+        restoredSeedYaml := false
+        err := filepath.WalkDir(previousDir, func(path string, entry fs.DirEntry, err error) error {
+            if err != nil || entry.IsDir() {
+                return err
+            }
+            relPath, err := filepath.Rel(previousDir, path)
+            if err != nil {
+                return err
+            }
+            switch relPath {
+            case previousManifest:
+            case "seed.yaml":
+                restoredSeedYaml = true
+            default:
+                restored = append(restored, relPath)
+            }
+            return nil
+        })
+        if err != nil {
+            return fmt.Errorf("failed to read previous seed generation: %w", err)
+        }
+        if restoredSeedYaml {
+            restored = append(restored, "seed.yaml")
+        }
+        for _, relPath := range strings.Split(string(manifest), "\n") {
+            if relPath != "" {
+                removed = append(removed, relPath)
+            }
+        }
+    }
+
+    nextDir := previousDir + ".next"
+    if err := os.RemoveAll(nextDir); err != nil {
+        return fmt.Errorf("failed to remove stale directory %s: %w", nextDir, err)
+    }
+    if err := swapInFiles(previousDir, seedDir, nextDir, restored, removed); err != nil {
+        return fmt.Errorf("failed to restore previous seed generation: %w", err)
+    }
+    if err := os.RemoveAll(previousDir); err != nil {
+        return fmt.Errorf("failed to remove restored seed generation: %w", err)
+    }
+    if err := os.Rename(nextDir, previousDir); err != nil {
+        return fmt.Errorf("failed to keep replaced seed generation: %w", err)
+    }
+    verboseLog("Restored previous seed generation from %s", previousDir)
+    return nil
+}
@@ -17,7 +17,6 @@ import (
     "encoding/hex"
     "fmt"
     "io"
-    "log"
     "os"
     "path/filepath"
     "strconv"
@@ -30,19 +29,27 @@ import (
 
 // verifyChecksum calculates the SHA3-384 checksum of a file and compares it with the expected checksum.
 func verifyChecksum(filePath, expectedChecksum string) (bool, error) {
+    calculatedChecksum, err := fileSha3_384(filePath)
+    if err != nil {
+        return false, err
+    }
+    return strings.EqualFold(calculatedChecksum, expectedChecksum), nil
+}
+
+// fileSha3_384 calculates the hex encoded SHA3-384 checksum of a file.
+func fileSha3_384(filePath string) (string, error) {
     file, err := os.Open(filePath)
     if err != nil {
-        return false, fmt.Errorf("failed to open file for checksum verification: %w", err)
+        return "", fmt.Errorf("failed to open file for checksum verification: %w", err)
     }
     defer file.Close()
 
     hash := sha3.New384()
     if _, err := io.Copy(hash, file); err != nil {
-        return false, fmt.Errorf("failed to calculate checksum: %w", err)
+        return "", fmt.Errorf("failed to calculate checksum: %w", err)
     }
 
-    calculatedChecksum := hex.EncodeToString(hash.Sum(nil))
-    return strings.EqualFold(calculatedChecksum, expectedChecksum), nil
+    return hex.EncodeToString(hash.Sum(nil)), nil
 }
 
 // extractRevisionFromFile extracts the revision number from a file name by splitting at the last underscore.
@@ -128,10 +135,10 @@ func removeSnapFromCurrentSnaps(snapName string, revision snap.Revision) {
 // initializeDirectories ensures that the snaps and assertions directories exist
 func initializeDirectories(snapsDir, assertionsDir string) {
     if err := os.MkdirAll(snapsDir, 0755); err != nil {
-        log.Fatalf("Failed to create snaps directory: %v", err)
+        fatalf("Failed to create snaps directory: %v", err)
     }
     if err := os.MkdirAll(assertionsDir, 0755); err != nil {
-        log.Fatalf("Failed to create assertions directory: %v", err)
+        fatalf("Failed to create assertions directory: %v", err)
     }
 }
 
@@ -185,3 +192,62 @@ func getVersionID() (string, error) {
 
     return "", fmt.Errorf("VERSION_ID not found in /etc/os-release")
 }
+
+// sameFile reports whether both paths lead to the same file, following symbolic links
+func sameFile(a, b string) bool {
+    aInfo, err := os.Stat(a)
+    if err != nil {
+        return false
+    }
+    bInfo, err := os.Stat(b)
+    if err != nil {
+        return false
+    }
+    return os.SameFile(aInfo, bInfo)
+}
+
+// copyFile copies src to dst, writing to a partial file first so an interrupted copy is never mistaken for a snap
+func copyFile(src, dst string) error {
+    in, err := os.Open(src)
+    if err != nil {
+        return err
+    }
+    defer in.Close()
+
+    partialPath := dst + ".partial"
+    out, err := os.Create(partialPath)
+    if err != nil {
+        return err
+    }
+    if _, err := io.Copy(out, in); err != nil {
+        out.Close()
+        os.Remove(partialPath)
+        return err
+    }
+    if err := out.Close(); err != nil {
+        os.Remove(partialPath)
+        return err
+    }
+    return os.Rename(partialPath, dst)
+}
+
+// writeOutput writes content to the file at path, or to standard output if path is "-"
+func writeOutput(path string, content []byte) error {
+    if path == "-" {
+        _, err := os.Stdout.Write(content)
+        return err
+    }
+    return os.WriteFile(path, content, 0644)
+}
+
+// stringList is a flag.Value collecting every occurrence of a repeatable flag
+type stringList []string
+
+func (l *stringList) String() string {
+    return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+    *l = append(*l, value)
+    return nil
+}
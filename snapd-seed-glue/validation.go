@@ -16,11 +16,19 @@ import (
     "encoding/base64"
     "fmt"
     "io/ioutil"
-    "log"
     "os"
     "os/exec"
     "path/filepath"
     "strings"
+
+    "github.com/snapcore/snapd/asserts"
+)
+
+const (
+    modelName  = "generic-classic"
+    modelBrand = "generic"
+    // Hardcoded series as snap.Info does not have a Series field
+    modelSeries = "16"
 )
 
 // validateSeed validates the seed using snap debug
@@ -28,7 +36,7 @@ func validateSeed(seedYaml string) error {
     cmd := exec.Command("snap", "debug", "validate-seed", seedYaml)
     output, err := cmd.CombinedOutput()
     if err != nil {
-        return fmt.Errorf("validation failed with output: %s, error: %v", string(output), err)
+        return &ValidationError{Output: string(output), Err: err}
     }
     verboseLog("Seed validation successful: %s", string(output))
     return nil
@@ -36,65 +44,100 @@ func validateSeed(seedYaml string) error {
 
 // ensureAssertions ensures that essential assertions are present
 func ensureAssertions(assertionsDir string) {
-    model := "generic-classic"
-    brand := "generic"
-    series := "16" // Hardcoded series as snap.Info does not have a Series field
-
     modelAssertionPath := filepath.Join(assertionsDir, "model")
     accountKeyAssertionPath := filepath.Join(assertionsDir, "account-key")
     accountAssertionPath := filepath.Join(assertionsDir, "account")
 
     // Check and generate model assertion
     if _, err := os.Stat(modelAssertionPath); os.IsNotExist(err) {
-        output, err := exec.Command("snap", "known", "--remote", "model", "series="+series, "model="+model, "brand-id="+brand).CombinedOutput()
-        if err != nil {
-            log.Fatalf("Failed to fetch model assertion: %v, Output: %s", err, string(output))
+        var output []byte
+        if seedModel != nil {
+            output = asserts.Encode(seedModel)
+        } else if output, err = fetchModelAssertion(); err != nil {
+            failf(errKindAssertion, "%v", err)
         }
         if err := ioutil.WriteFile(modelAssertionPath, output, 0644); err != nil {
-            log.Fatalf("Failed to write model assertion: %v", err)
+            failf(errKindAssertion, "Failed to write model assertion: %v", err)
         }
         verboseLog("Fetched and saved model assertion to %s", modelAssertionPath)
     }
+    progressTracker.Advance(requestCost, "")
 
     // Generate account-key assertion if not exists
     if _, err := os.Stat(accountKeyAssertionPath); os.IsNotExist(err) {
         signKeySha3 := grepPattern(modelAssertionPath, "sign-key-sha3-384: ")
         if signKeySha3 == "" {
-            log.Fatalf("Failed to extract sign-key-sha3-384 from model assertion.")
+            failf(errKindAssertion, "Failed to extract sign-key-sha3-384 from model assertion.")
         }
         output, err := exec.Command("snap", "known", "--remote", "account-key", "public-key-sha3-384="+signKeySha3).CombinedOutput()
         if err != nil {
-            log.Fatalf("Failed to fetch account-key assertion: %v, Output: %s", err, string(output))
+            failf(errKindAssertion, "Failed to fetch account-key assertion: %v, Output: %s", err, string(output))
         }
         if err := ioutil.WriteFile(accountKeyAssertionPath, output, 0644); err != nil {
-            log.Fatalf("Failed to write account-key assertion: %v", err)
+            failf(errKindAssertion, "Failed to write account-key assertion: %v", err)
         }
         verboseLog("Fetched and saved account-key assertion to %s", accountKeyAssertionPath)
     }
+    progressTracker.Advance(requestCost, "")
 
     // Generate account assertion if not exists
     if _, err := os.Stat(accountAssertionPath); os.IsNotExist(err) {
         accountId := grepPattern(accountKeyAssertionPath, "account-id: ")
         if accountId == "" {
-            log.Fatalf("Failed to extract account-id from account-key assertion.")
+            failf(errKindAssertion, "Failed to extract account-id from account-key assertion.")
         }
         output, err := exec.Command("snap", "known", "--remote", "account", "account-id="+accountId).CombinedOutput()
         if err != nil {
-            log.Fatalf("Failed to fetch account assertion: %v, Output: %s", err, string(output))
+            failf(errKindAssertion, "Failed to fetch account assertion: %v, Output: %s", err, string(output))
         }
         if err := ioutil.WriteFile(accountAssertionPath, output, 0644); err != nil {
-            log.Fatalf("Failed to write account assertion: %v", err)
+            failf(errKindAssertion, "Failed to write account assertion: %v", err)
         }
         verboseLog("Fetched and saved account assertion to %s", accountAssertionPath)
     }
+    progressTracker.Advance(requestCost, "")
+}
+
+// fetchModelAssertion fetches the model assertion for the seed from the store.
+// snap known does not tell why it failed, so a failure counts as the store being out of reach.
+func fetchModelAssertion() ([]byte, error) {
+    output, err := exec.Command("snap", "known", "--remote", "model", "series="+modelSeries, "model="+modelName, "brand-id="+modelBrand).CombinedOutput()
+    if err != nil {
+        return nil, &NetworkError{Err: fmt.Errorf("failed to fetch model assertion: %v, Output: %s", err, string(output))}
+    }
+    return output, nil
 }
 
+// loadSeedModel reads the model assertion of the seed, fetching it from the store if the seed has none yet
+func loadSeedModel(assertionsDir string) (*asserts.Model, error) {
+    modelAssertionPath := filepath.Join(assertionsDir, "model")
+    content, err := ioutil.ReadFile(modelAssertionPath)
+    if os.IsNotExist(err) {
+        content, err = fetchModelAssertion()
+    } else if err != nil {
+        err = &SeedError{Err: err}
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    assertion, err := asserts.Decode(content)
+    if err != nil {
+        return nil, &SeedError{Err: fmt.Errorf("failed to decode model assertion: %w", err)}
+    }
+    model, ok := assertion.(*asserts.Model)
+    if !ok {
+        return nil, &SeedError{Err: fmt.Errorf("expected a model assertion, got %s", assertion.Type().Name)}
+    }
+    verboseLog("Using model %s/%s (classic: %t, grade: %s)", model.BrandID(), model.Model(), model.Classic(), model.Grade())
+    return model, nil
+}
 
 // grepPattern extracts a specific pattern from a file
 func grepPattern(filePath, pattern string) string {
     content, err := ioutil.ReadFile(filePath)
     if err != nil {
-        log.Fatalf("Failed to read from file %s: %v", filePath, err)
+        failf(errKindAssertion, "Failed to read from file %s: %v", filePath, err)
     }
     lines := strings.Split(string(content), "\n")
     for _, line := range lines {
@@ -110,6 +153,6 @@ func grepPattern(filePath, pattern string) string {
             }
         }
     }
-    log.Fatalf("Pattern %s not found in file %s", pattern, filePath)
+    failf(errKindAssertion, "Pattern %s not found in file %s", pattern, filePath)
     return ""
 }